@@ -1,18 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log/slog"
+	"maps"
+	"math/big"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v4"
@@ -27,6 +49,131 @@ type firebaseConfig struct {
 	APIKey           string
 	AuthDomain       string
 	AuthEmulatorHost string // e.g. "firebase-emulator:9099"; empty = production
+	AuthEmulatorJWKS bool   // verify signed emulator tokens against the emulator's JWKS
+	EmulatorStrict   bool   // accept only unsigned (alg:"none") emulator tokens
+	EmulatorProbe    bool   // check at startup that the emulator is reachable
+	APIOnly          bool   // serve only the API routes, no HTML UI
+	JSONNoEscapeHTML bool   // leave <, > and & unescaped in JSON responses
+	OmitEmptyFields  bool   // omit empty email/name/picture from user JSON instead of sending ""
+	AuthRealm        string // realm in WWW-Authenticate; empty = project ID
+	LogSampleRate    int    // log 1 in N fast 2xx requests; 0 or 1 = log all
+	LogFormat        string // access log format: "json" (default) or "clf"
+	LogReqHeaders    bool   // debug-log loggedRequestHeaders of each request (dev only)
+	EnforceTokenTyp  bool   // reject tokens whose typ header is present but not "JWT"
+	EnforceKidFormat bool   // reject kids that don't look like Google key IDs before lookup
+	MaxTokenBytes    int    // longest accepted token; 0 = defaultMaxTokenBytes
+	AuthHeaderName   string // header carrying a bare token; empty = Authorization: Bearer
+	BasePath         string // path prefix the app is mounted at, e.g. "/auth"; empty = root
+
+	// MissingVars lists required variables that were unset when starting
+	// with ALLOW_DEGRADED; non-empty = misconfigured mode, where the API
+	// answers 503 and pages show a banner.
+	MissingVars []string
+
+	// Token verification
+	MaxIssuedAtSkew time.Duration // how far iat may be in the future; 0 = defaultMaxIssuedAtSkew
+	ValidIssuers    []string      // accepted ID token issuers; empty = the project's securetoken issuer
+	RequireEmail    bool          // reject verified tokens without an email (e.g. phone sign-in)
+	AuthDomainAud   bool          // also accept tokens whose aud is AuthDomain
+	ClockSkewLeeway time.Duration // tolerance for clock drift on exp, nbf and iat; 0 = none
+	AudForm         string        // required JSON form of aud: audFormString or audFormArray; empty = either
+	AllowPS256      bool          // also accept RSA-PSS (PS256) signatures, for non-Google issuers
+
+	// Development bypass: presenting DevBypassToken as the bearer token
+	// authenticates as the fixed DevBypassUID/DevBypassEmail user.
+	// Refused at startup when ENV=production.
+	DevBypassToken string
+	DevBypassUID   string
+	DevBypassEmail string
+
+	// AdminToken guards the /admin/ endpoints (Authorization: Bearer
+	// <token>); empty = the endpoints are not served.
+	AdminToken string
+
+	// Inbound header hygiene: StripHeaders are removed from requests
+	// unless they come from one of TrustedProxies.
+	StripHeaders   []string
+	TrustedProxies []netip.Prefix
+
+	// Air-gapped key source
+	GoogleCertsFile    string        // local x509 key map used instead of Google's endpoint
+	GoogleCertsFileTTL time.Duration // how long keys read from GoogleCertsFile are cached; 0 = 1h
+
+	// MaxCachedKeys rejects key sets larger than this; 0 = defaultMaxCachedKeys.
+	MaxCachedKeys int
+
+	// ColdStartWait is how long a request arriving before the first key
+	// set has loaded waits for the startup warmup before failing with a
+	// 503; 0 = no warmup, the request fetches the keys itself.
+	ColdStartWait time.Duration
+
+	// UnknownKidTTL is how long a kid found in no key set is remembered,
+	// so repeated tokens carrying it are rejected without another
+	// lookup or refresh; 0 = not remembered.
+	UnknownKidTTL time.Duration
+
+	// Sign-in UI
+	GoogleScopes         []string // extra OAuth scopes requested at sign-in
+	AvatarReferrerPolicy string   // referrerpolicy of the profile picture; empty = no-referrer
+	GoogleLoginHint      string   // login_hint pre-filling the account chooser
+	GoogleHostedDomain   string   // hd restricting the chooser to a Workspace domain
+
+	// RootRedirect, if set, makes GET / a 302 to this absolute http(s)
+	// URL or site-absolute path instead of the home page.
+	RootRedirect string
+
+	// GoogleClientID enables verifying Google-issued ID tokens (One Tap)
+	// whose audience is this OAuth client ID; empty = Firebase tokens only.
+	GoogleClientID string
+
+	// HTML caching
+	BuildVersion string        // folded into HTML ETags so a deploy invalidates caches
+	HTMLMaxAge   time.Duration // Cache-Control max-age for HTML pages; 0 = no-cache
+
+	// ErrorCodes renames error envelope codes (default code → sent code).
+	ErrorCodes map[string]string
+
+	// ClaimsValidator replaces the default issuer/audience/subject
+	// checks in verifyIDToken; nil = projectClaimsValidator.
+	ClaimsValidator claimsValidator
+
+	// Verifier replaces token verification for the API routes, e.g.
+	// with a fake in handler tests; nil = verify ID tokens as configured.
+	// Tokens must still be shaped like JWTs to reach it.
+	Verifier tokenVerifier
+
+	// ErrorReporter receives recovered panics and key fetch outages;
+	// nil = not reported. ERROR_REPORT_URL selects webhookErrorReporter.
+	ErrorReporter errorReporter
+}
+
+// buildVersion identifies the deployed build; set it at link time with
+// -ldflags "-X main.buildVersion=...".
+var buildVersion = "dev"
+
+// buildCommit is the git commit of the build, set at link time with
+// -ldflags "-X main.buildCommit=..."; empty = the VCS revision Go
+// embeds when building from a checkout, if any.
+var buildCommit = ""
+
+// versionInfo describes the running build.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentVersion returns the running build's version info.
+func currentVersion() versionInfo {
+	info := versionInfo{Version: buildVersion, Commit: buildCommit, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Commit == "" {
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+	return info
 }
 
 func loadFirebaseConfig() firebaseConfig {
@@ -46,13 +193,203 @@ func loadFirebaseConfig() firebaseConfig {
 		missing = append(missing, "FIREBASE_AUTH_DOMAIN")
 	}
 	if len(missing) > 0 {
-		slog.Error("missing required environment variables", "vars", strings.Join(missing, ", "))
-		os.Exit(1)
+		if os.Getenv("ALLOW_DEGRADED") != "true" {
+			slog.Error("missing required environment variables", "vars", strings.Join(missing, ", "))
+			os.Exit(1)
+		}
+		slog.Error("missing required environment variables, starting in misconfigured mode", "vars", strings.Join(missing, ", "))
+		cfg.MissingVars = missing
 	}
 
 	cfg.AuthEmulatorHost = os.Getenv("FIREBASE_AUTH_EMULATOR_HOST")
 	if cfg.AuthEmulatorHost != "" {
-		slog.Warn("running with Firebase Auth emulator", "host", cfg.AuthEmulatorHost)
+		// CI runs against the emulator on purpose and can quiet this down.
+		level := slog.LevelWarn
+		if os.Getenv("SUPPRESS_EMULATOR_WARNING") == "true" {
+			level = slog.LevelDebug
+		}
+		slog.Log(context.Background(), level, "running with Firebase Auth emulator", "host", cfg.AuthEmulatorHost)
+	}
+	cfg.AuthEmulatorJWKS = os.Getenv("FIREBASE_AUTH_EMULATOR_JWKS") == "true"
+	cfg.EmulatorStrict = os.Getenv("EMULATOR_STRICT") == "true"
+	cfg.EmulatorProbe = os.Getenv("EMULATOR_PROBE") == "true"
+	cfg.APIOnly = os.Getenv("API_ONLY") == "true"
+	cfg.RequireEmail = os.Getenv("REQUIRE_EMAIL") == "true"
+	cfg.AuthDomainAud = os.Getenv("AUTH_DOMAIN_AUDIENCE") == "true"
+	cfg.AllowPS256 = os.Getenv("ALLOW_PS256") == "true"
+	cfg.LogReqHeaders = os.Getenv("LOG_REQUEST_HEADERS") == "true"
+	cfg.JSONNoEscapeHTML = os.Getenv("JSON_ESCAPE_HTML") == "false"
+	cfg.OmitEmptyFields = os.Getenv("OMIT_EMPTY_FIELDS") == "true"
+	cfg.AuthRealm = os.Getenv("AUTH_REALM")
+	cfg.EnforceTokenTyp = os.Getenv("ENFORCE_TOKEN_TYP") == "true"
+	cfg.EnforceKidFormat = os.Getenv("ENFORCE_KID_FORMAT") == "true"
+	if name := os.Getenv("AUTH_HEADER_NAME"); !strings.EqualFold(name, "Authorization") {
+		cfg.AuthHeaderName = name
+	}
+	for _, iss := range strings.Split(os.Getenv("VALID_ISSUERS"), ",") {
+		if iss = strings.TrimSpace(iss); iss != "" {
+			cfg.ValidIssuers = append(cfg.ValidIssuers, iss)
+		}
+	}
+	for _, name := range strings.Split(os.Getenv("STRIP_REQUEST_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			cfg.StripHeaders = append(cfg.StripHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		prefix, err := parseProxyPrefix(v)
+		if err != nil {
+			slog.Error("invalid TRUSTED_PROXIES entry, must be an IP or CIDR", "value", v)
+			os.Exit(1)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, prefix)
+	}
+	for _, scope := range strings.Split(os.Getenv("GOOGLE_SCOPES"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			cfg.GoogleScopes = append(cfg.GoogleScopes, scope)
+		}
+	}
+	if v := os.Getenv("MAX_TOKEN_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			slog.Error("invalid MAX_TOKEN_BYTES, must be a positive integer", "value", v)
+			os.Exit(1)
+		}
+		cfg.MaxTokenBytes = n
+	}
+	if v := os.Getenv("MAX_IAT_SKEW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Error("invalid MAX_IAT_SKEW, must be a positive duration", "value", v)
+			os.Exit(1)
+		}
+		cfg.MaxIssuedAtSkew = d
+	}
+	if v := os.Getenv("CLOCK_SKEW_LEEWAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			slog.Error("invalid CLOCK_SKEW_LEEWAY, must be a non-negative duration", "value", v)
+			os.Exit(1)
+		}
+		cfg.ClockSkewLeeway = d
+	}
+	cfg.GoogleLoginHint = os.Getenv("GOOGLE_LOGIN_HINT")
+	cfg.GoogleHostedDomain = os.Getenv("GOOGLE_HD")
+	cfg.GoogleClientID = os.Getenv("GOOGLE_CLIENT_ID")
+	if v := os.Getenv("AVATAR_REFERRER_POLICY"); v != "" {
+		if !slices.Contains(referrerPolicies, v) {
+			slog.Error("invalid AVATAR_REFERRER_POLICY", "value", v, "allowed", strings.Join(referrerPolicies, ", "))
+			os.Exit(1)
+		}
+		cfg.AvatarReferrerPolicy = v
+	}
+	if v := os.Getenv("ROOT_REDIRECT"); v != "" {
+		if err := checkRedirectTarget(v); err != nil {
+			slog.Error("invalid ROOT_REDIRECT", "value", v, "error", err.Error())
+			os.Exit(1)
+		}
+		cfg.RootRedirect = v
+	}
+	if v := os.Getenv("BASE_PATH"); v != "" && v != "/" {
+		if !strings.HasPrefix(v, "/") || path.Clean(v) != strings.TrimSuffix(v, "/") {
+			slog.Error("invalid BASE_PATH, must be a clean absolute path like /auth", "value", v)
+			os.Exit(1)
+		}
+		cfg.BasePath = strings.TrimSuffix(v, "/")
+	}
+	switch v := os.Getenv("LOG_FORMAT"); v {
+	case "", "json":
+	case "clf":
+		cfg.LogFormat = v
+	default:
+		slog.Error("invalid LOG_FORMAT, must be json or clf", "value", v)
+		os.Exit(1)
+	}
+	switch v := os.Getenv("AUD_FORM"); v {
+	case "":
+	case audFormString, audFormArray:
+		cfg.AudForm = v
+	default:
+		slog.Error("invalid AUD_FORM, must be string or array", "value", v)
+		os.Exit(1)
+	}
+	cfg.DevBypassToken = os.Getenv("DEV_BYPASS_TOKEN")
+	if cfg.DevBypassToken != "" {
+		if err := checkDevBypassAllowed(os.Getenv("ENV")); err != nil {
+			slog.Error("refusing to start", "error", err.Error())
+			os.Exit(1)
+		}
+		cfg.DevBypassUID = cmp.Or(os.Getenv("DEV_BYPASS_UID"), "dev-user")
+		cfg.DevBypassEmail = cmp.Or(os.Getenv("DEV_BYPASS_EMAIL"), "dev@example.com")
+		slog.Warn("DEV_BYPASS_TOKEN is set: the bypass token authenticates without verification", "uid", cfg.DevBypassUID)
+	}
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	if v := os.Getenv("MAX_CACHED_KEYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			slog.Error("invalid MAX_CACHED_KEYS, must be a positive integer", "value", v)
+			os.Exit(1)
+		}
+		cfg.MaxCachedKeys = n
+	}
+	if v := os.Getenv("COLD_START_WAIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Error("invalid COLD_START_WAIT, must be a positive duration", "value", v)
+			os.Exit(1)
+		}
+		cfg.ColdStartWait = d
+	}
+	if v := os.Getenv("UNKNOWN_KID_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Error("invalid UNKNOWN_KID_TTL, must be a positive duration", "value", v)
+			os.Exit(1)
+		}
+		cfg.UnknownKidTTL = d
+	}
+	if u := os.Getenv("ERROR_REPORT_URL"); u != "" {
+		cfg.ErrorReporter = webhookErrorReporter{url: u}
+	}
+	cfg.GoogleCertsFile = os.Getenv("GOOGLE_CERTS_FILE")
+	if v := os.Getenv("GOOGLE_CERTS_FILE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Error("invalid GOOGLE_CERTS_FILE_TTL, must be a positive duration", "value", v)
+			os.Exit(1)
+		}
+		cfg.GoogleCertsFileTTL = d
+	}
+	cfg.BuildVersion = buildVersion
+	if v := os.Getenv("ERROR_CODE_MAP"); v != "" {
+		cfg.ErrorCodes = map[string]string{}
+		for _, pair := range strings.Split(v, ",") {
+			from, to, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || to == "" || !slices.Contains(errorCodes, from) {
+				slog.Error("invalid ERROR_CODE_MAP entry, want CODE=REPLACEMENT for a known code", "entry", pair, "codes", strings.Join(errorCodes, ", "))
+				os.Exit(1)
+			}
+			cfg.ErrorCodes[from] = to
+		}
+	}
+	if v := os.Getenv("HTML_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			slog.Error("invalid HTML_MAX_AGE, must be a non-negative duration", "value", v)
+			os.Exit(1)
+		}
+		cfg.HTMLMaxAge = d
+	}
+	if v := os.Getenv("LOG_SAMPLE_RATE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			slog.Error("invalid LOG_SAMPLE_RATE, must be a positive integer", "value", v)
+			os.Exit(1)
+		}
+		cfg.LogSampleRate = n
 	}
 	return cfg
 }
@@ -63,245 +400,1752 @@ func loadFirebaseConfig() firebaseConfig {
 
 const googleCertsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
 
-type publicKeyCache struct {
+// emulatorJWKSPath is where the Auth emulator mirrors Google's JWKS
+// endpoint, relative to the emulator host.
+const emulatorJWKSPath = "/www.googleapis.com/service_accounts/v1/jwk/securetoken@system.gserviceaccount.com"
+
+// keyStore holds the fetched public key set. The default is an
+// in-memory map; multi-instance deployments can supply a shared store
+// (e.g. Redis) so that instances don't each fetch the keys.
+type keyStore interface {
+	// Get returns the key for kid, if present, and the expiry of the
+	// stored key set (zero if nothing is stored). The expiry is returned
+	// even when kid is not found.
+	Get(kid string) (key *rsa.PublicKey, expiry time.Time, ok bool)
+	// Expiry returns the expiry of the stored key set, zero if nothing
+	// is stored.
+	Expiry() time.Time
+	// Set replaces the stored key set.
+	Set(keys map[string]*rsa.PublicKey, expiry time.Time)
+}
+
+type memoryKeyStore struct {
 	mu     sync.RWMutex
 	keys   map[string]*rsa.PublicKey
 	expiry time.Time
 }
 
-var keyCache = &publicKeyCache{}
+func (s *memoryKeyStore) Get(kid string) (*rsa.PublicKey, time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[kid]
+	return key, s.expiry, ok
+}
 
-func (c *publicKeyCache) getKey(kid string) (*rsa.PublicKey, error) {
-	c.mu.RLock()
-	if time.Now().Before(c.expiry) {
-		if key, ok := c.keys[kid]; ok {
-			c.mu.RUnlock()
+func (s *memoryKeyStore) Expiry() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expiry
+}
+
+func (s *memoryKeyStore) Set(keys map[string]*rsa.PublicKey, expiry time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.expiry = expiry
+}
+
+type publicKeyCache struct {
+	url         string
+	parse       func(body []byte) (map[string]*rsa.PublicKey, error)
+	store       keyStore
+	durations   *histogram   // refresh attempt durations; nil = not recorded
+	fetching    sync.Mutex   // held by the one refresh allowed to fetch at a time
+	mu          sync.RWMutex // guards lastRefresh, lastForced and unknownKids
+	lastRefresh time.Time    // time of the last successful refresh
+	lastForced  time.Time    // time of the last forced fetch attempt, successful or not
+
+	// fileTTL is the cache lifetime of a key set read from a file://
+	// URL; 0 = 1h.
+	fileTTL time.Duration
+
+	// maxKeys is the largest key set accepted from the endpoint; 0 =
+	// defaultMaxCachedKeys.
+	maxKeys int
+
+	// coldStartWait bounds how long a lookup waits for the first key set
+	// when none is loaded yet; 0 = fetch it synchronously, unbounded.
+	// warm is closed once the first key set has loaded; warming is set
+	// while a warmup fetch is running.
+	coldStartWait time.Duration
+	warmInit      sync.Once
+	warmDone      sync.Once
+	warm          chan struct{}
+	warming       atomic.Bool
+
+	// unknownKidTTL is how long a kid missing from the key set is
+	// remembered in unknownKids, mapped to when it is forgotten; 0 =
+	// not remembered. A successful refresh forgets them all.
+	unknownKidTTL time.Duration
+	unknownKids   map[string]time.Time
+
+	// generation counts successful refreshes, so a verification can be
+	// tied to the key set that served it.
+	generation atomic.Uint64
+
+	// onRefresh, if set, is called after each refresh attempt with the
+	// number of keys fetched, the expiry of the stored set and the
+	// attempt's error. It runs before the fetch lock is released and
+	// must not refresh the cache; tests use it to wait for a refresh.
+	onRefresh func(keyCount int, expiry time.Time, err error)
+}
+
+var keyCache = &publicKeyCache{
+	url:       googleCertsURL,
+	parse:     parseX509Certs,
+	store:     &memoryKeyStore{},
+	durations: newHistogram(0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+}
+
+var (
+	emulatorKeyCachesMu sync.Mutex
+	emulatorKeyCaches   = map[string]*publicKeyCache{}
+)
+
+// emulatorKeyCache returns the JWKS-backed key cache for an emulator
+// host, creating it on first use.
+func emulatorKeyCache(host string) *publicKeyCache {
+	emulatorKeyCachesMu.Lock()
+	defer emulatorKeyCachesMu.Unlock()
+	c, ok := emulatorKeyCaches[host]
+	if !ok {
+		c = &publicKeyCache{
+			url:   "http://" + host + emulatorJWKSPath,
+			parse: parseJWKS,
+			store: &memoryKeyStore{},
+		}
+		emulatorKeyCaches[host] = c
+	}
+	return c
+}
+
+// defaultMaxCachedKeys is the default limit on the size of a fetched
+// key set.
+const defaultMaxCachedKeys = 20
+
+// refreshIDs numbers refreshes not triggered by a request.
+var refreshIDs atomic.Uint64
+
+// refreshLogAttrs correlates refresh logs with their trigger: the ID of
+// the request that lazily triggered the refresh, or a synthetic ID
+// marked scheduled for refreshes outside any request.
+func refreshLogAttrs(ctx context.Context) []any {
+	if id := requestIDFrom(ctx); id != "" {
+		return []any{"request_id", id, "scheduled", false}
+	}
+	return []any{"request_id", fmt.Sprintf("refresh-%d", refreshIDs.Add(1)), "scheduled", true}
+}
+
+// minForcedRefreshInterval bounds how often an unknown kid can force a
+// refresh of an unexpired key set, so a stream of tokens with bogus kids
+// can't turn into a stream of fetches.
+const minForcedRefreshInterval = time.Minute
+
+func (c *publicKeyCache) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	key, expiry, ok := c.store.Get(kid)
+	if !ok && c.isUnknownKid(kid) {
+		return nil, fmt.Errorf("%w: key ID %q recently not found", errUnknownKey, kid)
+	}
+	if expiry.IsZero() && c.coldStartWait > 0 {
+		return c.awaitWarmup(ctx, kid)
+	}
+	if time.Now().Before(expiry) {
+		if ok {
+			return key, nil
+		}
+		// An unknown kid in a fresh key set usually means the keys were
+		// rotated early; refetch once rather than waiting for expiry.
+		if err := c.refresh(ctx, true); err != nil {
+			slog.Warn("forced public key refresh failed", append(refreshLogAttrs(ctx), "url", c.url, "kid", kid, "error", err.Error())...)
+			return nil, c.unknownKid(kid, "not found in cache")
+		}
+		if key, _, ok := c.store.Get(kid); ok {
 			return key, nil
 		}
-		c.mu.RUnlock()
-		return nil, fmt.Errorf("key ID %q not found in cache", kid)
+		return nil, c.unknownKid(kid, "not found in cache")
 	}
-	c.mu.RUnlock()
 
 	// Cache expired or empty — refresh
-	if err := c.refresh(); err != nil {
-		return nil, fmt.Errorf("failed to refresh public keys: %w", err)
+	if err := c.refresh(ctx, false); err != nil {
+		return nil, fmt.Errorf("%w: %w", errKeyFetchFailed, err)
+	}
+
+	if key, _, ok := c.store.Get(kid); ok {
+		return key, nil
+	}
+	return nil, c.unknownKid(kid, "not found after refresh")
+}
+
+// unknownKid remembers kid as missing from the key set for
+// c.unknownKidTTL and returns the errUnknownKey to report for it.
+func (c *publicKeyCache) unknownKid(kid, reason string) error {
+	if c.unknownKidTTL > 0 {
+		now := time.Now()
+		c.mu.Lock()
+		if c.unknownKids == nil {
+			c.unknownKids = map[string]time.Time{}
+		}
+		// Drop expired entries so a stream of distinct bogus kids
+		// doesn't grow the map without bound.
+		maps.DeleteFunc(c.unknownKids, func(_ string, until time.Time) bool { return now.After(until) })
+		c.unknownKids[kid] = now.Add(c.unknownKidTTL)
+		c.mu.Unlock()
 	}
+	return fmt.Errorf("%w: key ID %q %s", errUnknownKey, kid, reason)
+}
 
+// isUnknownKid reports whether kid was recently found missing from the
+// key set.
+func (c *publicKeyCache) isUnknownKid(kid string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	if key, ok := c.keys[kid]; ok {
+	until, ok := c.unknownKids[kid]
+	return ok && time.Now().Before(until)
+}
+
+// warmed returns a channel closed once the first key set has loaded.
+func (c *publicKeyCache) warmed() chan struct{} {
+	c.warmInit.Do(func() { c.warm = make(chan struct{}) })
+	return c.warm
+}
+
+// warmup loads the first key set in the background, so requests
+// arriving at a cold start find it loaded or in flight. It is a no-op
+// while a warmup is already running, so callers that stop waiting
+// don't leave fetches queued behind it.
+func (c *publicKeyCache) warmup(ctx context.Context) {
+	if !c.warming.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.warming.Store(false)
+		if err := c.refresh(ctx, false); err != nil {
+			slog.Warn("public key warmup failed", "url", c.url, "error", err.Error())
+		}
+	}()
+}
+
+// awaitWarmup looks up kid once the first key set has loaded, waiting at
+// most c.coldStartWait for it. A refresh is started in case the startup
+// warmup failed.
+func (c *publicKeyCache) awaitWarmup(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.warmup(context.WithoutCancel(ctx))
+	timer := time.NewTimer(c.coldStartWait)
+	defer timer.Stop()
+	select {
+	case <-c.warmed():
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: keys not loaded within %s of cold start", errKeyFetchFailed, c.coldStartWait)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", errKeyFetchFailed, ctx.Err())
+	}
+	if key, _, ok := c.store.Get(kid); ok {
 		return key, nil
 	}
-	return nil, fmt.Errorf("key ID %q not found after refresh", kid)
+	return nil, fmt.Errorf("%w: key ID %q not found after warmup", errUnknownKey, kid)
 }
 
-func (c *publicKeyCache) refresh() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// refresh fetches the key set. Unless force is set, it is a no-op while
+// the stored set is unexpired; forced refreshes are instead limited to
+// one attempt per minForcedRefreshInterval, whether or not it succeeds.
+//
+// Only one refresh fetches at a time. The fetch and parse run without
+// holding mu, and the stored set is swapped only once the new one is
+// complete. While a fetch is in flight, other callers return at once
+// and keep serving the previous keys, even expired ones; only a cache
+// with no keys at all waits for the fetch.
+func (c *publicKeyCache) refresh(ctx context.Context, force bool) (err error) {
+	if !c.fetching.TryLock() {
+		if !c.store.Expiry().IsZero() {
+			return nil
+		}
+		c.fetching.Lock()
+	}
+	defer c.fetching.Unlock()
 
-	// Double-check after acquiring write lock
-	if time.Now().Before(c.expiry) {
+	// Double-check now that no other fetch is in flight; another caller
+	// (or another instance sharing the store) may have refreshed
+	// meanwhile.
+	c.mu.Lock()
+	lastRefresh, lastForced := c.lastRefresh, c.lastForced
+	if force {
+		// Failed attempts count too, so an endpoint outage doesn't turn
+		// every unknown kid into another fetch.
+		if time.Since(lastRefresh) < minForcedRefreshInterval || time.Since(lastForced) < minForcedRefreshInterval {
+			c.mu.Unlock()
+			return nil
+		}
+		c.lastForced = time.Now()
+	}
+	c.mu.Unlock()
+	if !force && time.Now().Before(c.store.Expiry()) {
 		return nil
 	}
 
-	resp, err := http.Get(googleCertsURL)
+	start := time.Now()
+	defer func() { c.durations.observe(time.Since(start).Seconds()) }()
+
+	var keyCount int
+	if c.onRefresh != nil {
+		defer func() {
+			c.onRefresh(keyCount, c.store.Expiry(), err)
+		}()
+	}
+
+	body, maxAge, err := c.fetch()
+	if err != nil {
+		return err
+	}
+
+	keys, err := c.parse(body)
+	if err != nil {
+		return err
+	}
+	// An empty set would leave nothing to verify against; keep the
+	// previous keys rather than replacing them with it.
+	if len(keys) == 0 {
+		return errors.New("certs response contained no keys")
+	}
+	// Google publishes two or three keys at a time; a much larger set is
+	// a broken or hostile endpoint, and caching it would grow unbounded.
+	maxKeys := cmp.Or(c.maxKeys, defaultMaxCachedKeys)
+	if len(keys) > maxKeys {
+		return fmt.Errorf("certs response contained %d keys, more than the limit of %d", len(keys), maxKeys)
+	}
+
+	keyCount = len(keys)
+	now := time.Now()
+	c.store.Set(keys, now.Add(time.Duration(maxAge)*time.Second))
+	c.mu.Lock()
+	c.lastRefresh = now
+	clear(c.unknownKids)
+	c.mu.Unlock()
+	c.warmDone.Do(func() { close(c.warmed()) })
+	gen := c.generation.Add(1)
+	slog.Info("refreshed public keys", append(refreshLogAttrs(ctx),
+		"url", c.url, "count", len(keys), "expires_in_seconds", maxAge, "generation", gen)...)
+	return nil
+}
+
+// keyFetchClient bounds how long a key set fetch may take, so a hung
+// key endpoint can't hold the fetch lock indefinitely.
+var keyFetchClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetch returns the raw key set and how long it may be cached, in
+// seconds. A file:// URL is read from disk and cached for c.fileTTL, for
+// environments that can't reach Google.
+func (c *publicKeyCache) fetch() (body []byte, maxAge int, err error) {
+	if path, ok := strings.CutPrefix(c.url, "file://"); ok {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading certs file: %w", err)
+		}
+		ttl := c.fileTTL
+		if ttl <= 0 {
+			ttl = time.Hour
+		}
+		return body, int(ttl.Seconds()), nil
+	}
+
+	resp, err := keyFetchClient.Get(c.url)
 	if err != nil {
-		return fmt.Errorf("fetching Google certs: %w", err)
+		return nil, 0, fmt.Errorf("fetching certs: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err = io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("reading Google certs response: %w", err)
+		return nil, 0, fmt.Errorf("reading certs response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Google certs returned status %d", resp.StatusCode)
+		return nil, 0, fmt.Errorf("certs endpoint returned status %d", resp.StatusCode)
+	}
+
+	// Parse max-age from Cache-Control header
+	maxAge = 3600 // default 1 hour
+	if cc := resp.Header.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.TrimSpace(directive)
+			if strings.HasPrefix(directive, "max-age=") {
+				if v, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+					maxAge = v
+				}
+			}
+		}
+	}
+	return body, maxAge, nil
+}
+
+// ready reports whether a key set has been loaded. Expired keys still
+// count: they are refreshed on the next lookup. It never waits for a
+// fetch, so a health probe can't hang on the key endpoint; if no set
+// is loaded, it starts loading one in the background.
+func (c *publicKeyCache) ready(ctx context.Context) bool {
+	if !c.store.Expiry().IsZero() {
+		return true
 	}
+	c.warmup(context.WithoutCancel(ctx))
+	return false
+}
 
+// parseX509Certs parses Google's kid → PEM certificate map.
+func parseX509Certs(body []byte) (map[string]*rsa.PublicKey, error) {
 	var certMap map[string]string
 	if err := json.Unmarshal(body, &certMap); err != nil {
-		return fmt.Errorf("parsing Google certs JSON: %w", err)
+		return nil, fmt.Errorf("parsing certs JSON: %w", err)
 	}
 
 	keys := make(map[string]*rsa.PublicKey, len(certMap))
 	for kid, certPEM := range certMap {
 		block, _ := pem.Decode([]byte(certPEM))
 		if block == nil {
-			return fmt.Errorf("failed to decode PEM for key %q", kid)
+			return nil, fmt.Errorf("failed to decode PEM for key %q", kid)
 		}
 		cert, err := x509.ParseCertificate(block.Bytes)
 		if err != nil {
-			return fmt.Errorf("parsing certificate for key %q: %w", kid, err)
+			return nil, fmt.Errorf("parsing certificate for key %q: %w", kid, err)
 		}
 		rsaKey, ok := cert.PublicKey.(*rsa.PublicKey)
 		if !ok {
-			return fmt.Errorf("key %q is not RSA", kid)
+			return nil, fmt.Errorf("key %q is not RSA", kid)
 		}
 		keys[kid] = rsaKey
 	}
+	return keys, nil
+}
 
-	// Parse max-age from Cache-Control header
-	maxAge := 3600 // default 1 hour
-	if cc := resp.Header.Get("Cache-Control"); cc != "" {
-		for _, directive := range strings.Split(cc, ",") {
-			directive = strings.TrimSpace(directive)
-			if strings.HasPrefix(directive, "max-age=") {
-				if v, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
-					maxAge = v
-				}
-			}
-		}
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// parseJWKS parses a JSON Web Key Set, keeping only its RSA keys.
+func parseJWKS(body []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS JSON: %w", err)
 	}
 
-	c.keys = keys
-	c.expiry = time.Now().Add(time.Duration(maxAge) * time.Second)
-	slog.Info("refreshed Google public keys", "count", len(keys), "expires_in_seconds", maxAge)
-	return nil
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || k.Kid == "" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decoding modulus for key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decoding exponent for key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
 }
 
 // ──────────────────────────────────────────────
-// JWT Verification
+// Metrics (Prometheus text exposition format)
 // ──────────────────────────────────────────────
 
-type userClaims struct {
-	UID     string `json:"uid"`
-	Email   string `json:"email"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, ascending
+	counts  []uint64  // cumulative count per bucket
+	sum     float64
+	count   uint64
 }
 
-type firebaseClaims struct {
-	jwt.RegisteredClaims
-	Email   string `json:"email"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
 }
 
-// verifyEmulatorToken parses an unsigned emulator token without
-// signature verification. The emulator uses alg:"none".
-func verifyEmulatorToken(tokenString string, projectID string) (*userClaims, error) {
-	parser := jwt.NewParser(
-		jwt.WithValidMethods([]string{"none", "RS256"}),
-		jwt.WithoutClaimsValidation(),
-	)
-
-	token, _, err := parser.ParseUnverified(tokenString, &firebaseClaims{})
-	if err != nil {
-		return nil, fmt.Errorf("parsing emulator token: %w", err)
+func (h *histogram) observe(v float64) {
+	if h == nil {
+		return
 	}
-
-	claims, ok := token.Claims.(*firebaseClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid emulator token claims")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
 	}
+	h.sum += v
+	h.count++
+}
 
-	if claims.Subject == "" {
-		return nil, fmt.Errorf("emulator token subject (uid) is empty")
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
 	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64), name, h.count)
+}
 
-	return &userClaims{
-		UID:     claims.Subject,
-		Email:   claims.Email,
-		Name:    claims.Name,
-		Picture: claims.Picture,
-	}, nil
+// counterVec is a counter partitioned by label values. Callers pass
+// one value per label name, in order.
+type counterVec struct {
+	mu         sync.Mutex
+	labelNames []string
+	counts     map[string]uint64 // keyed by the values joined with \x00
 }
 
-func verifyIDToken(tokenString string, projectID string) (*userClaims, error) {
-	// Parse without verification first to get the key ID
-	token, parts, err := jwt.NewParser().ParseUnverified(tokenString, &firebaseClaims{})
-	if err != nil {
-		return nil, fmt.Errorf("parsing token: %w", err)
-	}
-	_ = parts
+func newCounterVec(labelNames ...string) *counterVec {
+	return &counterVec{labelNames: labelNames, counts: map[string]uint64{}}
+}
 
-	// Check algorithm
-	if token.Method.Alg() != "RS256" {
-		return nil, fmt.Errorf("unexpected signing algorithm: %s", token.Method.Alg())
-	}
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[strings.Join(values, "\x00")]++
+}
 
-	// Get the key ID
-	kid, ok := token.Header["kid"].(string)
-	if !ok || kid == "" {
-		return nil, fmt.Errorf("missing kid in token header")
-	}
+func (c *counterVec) get(values ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[strings.Join(values, "\x00")]
+}
 
-	// Fetch the public key
-	pubKey, err := keyCache.getKey(kid)
-	if err != nil {
-		return nil, err
+func (c *counterVec) write(w io.Writer, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, key := range slices.Sorted(maps.Keys(c.counts)) {
+		var labels []string
+		for i, value := range strings.Split(key, "\x00") {
+			labels = append(labels, fmt.Sprintf("%s=%q", c.labelNames[i], value))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", name, strings.Join(labels, ","), c.counts[key])
 	}
+}
 
-	// Parse and verify the token with the public key
-	expectedIssuer := "https://securetoken.google.com/" + projectID
-	verifiedToken, err := jwt.ParseWithClaims(tokenString, &firebaseClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return pubKey, nil
-	},
-		jwt.WithValidMethods([]string{"RS256"}),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("token verification failed: %w", err)
-	}
+// unmatchedRoute labels requests no route pattern matched.
+const unmatchedRoute = "unmatched"
 
-	claims, ok := verifiedToken.Claims.(*firebaseClaims)
-	if !ok || !verifiedToken.Valid {
-		return nil, fmt.Errorf("invalid token claims")
-	}
+// requestsByRoute counts requests by routeLabel.
+var requestsByRoute = newCounterVec("route")
 
-	if claims.Subject == "" {
-		return nil, fmt.Errorf("token subject (uid) is empty")
-	}
+// notFoundTotal counts 404s answered by the catch-all handler, which
+// point at misconfigured clients or scanners.
+var notFoundTotal atomic.Uint64
 
-	// Verify issuer
-	if claims.Issuer != expectedIssuer {
-		return nil, fmt.Errorf("invalid issuer: got %q, want %q", claims.Issuer, expectedIssuer)
-	}
+// responsesByRoute counts responses by routeLabel and status class
+// ("2xx", "4xx", ...), to show which endpoints are erroring.
+var responsesByRoute = newCounterVec("route", "status_class")
 
-	// Verify audience
-	foundAud := false
-	for _, aud := range claims.Audience {
-		if aud == projectID {
-			foundAud = true
-			break
-		}
-	}
-	if !foundAud {
-		return nil, fmt.Errorf("invalid audience: %v does not contain %q", claims.Audience, projectID)
-	}
+// statusClass returns the class of an HTTP status code, e.g. "4xx".
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
 
-	return &userClaims{
-		UID:     claims.Subject,
-		Email:   claims.Email,
-		Name:    claims.Name,
-		Picture: claims.Picture,
-	}, nil
+// routeSlot is where the mux records how it routed a request, for
+// middleware running outside it.
+type routeSlot struct {
+	pattern  string // the pattern that matched; empty = unmatched
+	notFound bool   // answered 404 by the catch-all handler
 }
 
-// ──────────────────────────────────────────────
-// JSON Helpers
-// ──────────────────────────────────────────────
+// routeSlotKey is the context key of a request's *routeSlot.
+type routeSlotKey struct{}
 
-type errorEnvelope struct {
-	Error errorDetail `json:"error"`
+// withRouteSlot returns ctx carrying an empty route slot.
+func withRouteSlot(ctx context.Context) (context.Context, *routeSlot) {
+	slot := &routeSlot{}
+	return context.WithValue(ctx, routeSlotKey{}, slot), slot
 }
 
-type errorDetail struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+// recordRoute stores label in ctx's route slot, if it has one.
+func recordRoute(ctx context.Context, label string) {
+	if slot, ok := ctx.Value(routeSlotKey{}).(*routeSlot); ok {
+		slot.pattern = label
+	}
+}
+
+// markNotFound flags ctx's route slot, if it has one, as answered by
+// the catch-all handler.
+func markNotFound(ctx context.Context) {
+	if slot, ok := ctx.Value(routeSlotKey{}).(*routeSlot); ok {
+		slot.notFound = true
+	}
+}
+
+// routeLabel returns the metrics label for a request the mux has
+// served: the pattern that matched it, e.g. "GET /api/me". Raw paths
+// are never used, since they are unbounded; requests that fell through
+// to the catch-all or matched nothing share unmatchedRoute.
+func routeLabel(r *http.Request) string {
+	if r.Pattern == "" || r.Pattern == "/" {
+		return unmatchedRoute
+	}
+	return r.Pattern
+}
+
+// writeKeyCacheMetrics writes the age and refresh-duration metrics of a
+// key cache. The age gauge is omitted until the first successful refresh.
+func writeKeyCacheMetrics(w io.Writer, c *publicKeyCache) {
+	c.mu.RLock()
+	last := c.lastRefresh
+	c.mu.RUnlock()
+
+	fmt.Fprint(w, "# HELP key_cache_age_seconds Seconds since the last successful public key refresh.\n# TYPE key_cache_age_seconds gauge\n")
+	if !last.IsZero() {
+		fmt.Fprintf(w, "key_cache_age_seconds %s\n", strconv.FormatFloat(time.Since(last).Seconds(), 'f', 3, 64))
+	}
+	if c.durations != nil {
+		c.durations.write(w, "key_cache_refresh_duration_seconds", "Duration of public key refresh attempts.")
+	}
+}
+
+// ──────────────────────────────────────────────
+// JWT Verification
+// ──────────────────────────────────────────────
+
+// Sentinel errors classifying why verification failed. Errors returned
+// by the verifiers wrap exactly one of these, so callers can pick a
+// response with errors.Is while the full chain is kept for logging.
+var (
+	errMalformedToken   = errors.New("malformed token")
+	errUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	errMissingKid       = errors.New("missing key ID")
+	errUnknownKey       = errors.New("unknown signing key")
+	errKeyFetchFailed   = errors.New("public key fetch failed")
+	errInvalidSignature = errors.New("invalid signature")
+	errTokenExpired     = errors.New("token expired")
+	errInvalidClaims    = errors.New("invalid claims")
+	errTokenInfoFailed  = errors.New("tokeninfo request failed")
+	errIssuedInFuture   = errors.New("token issued in the future")
+	errEmailRequired    = errors.New("email required")
+)
+
+var verificationErrors = []error{
+	errMalformedToken, errUnsupportedAlg, errMissingKid, errUnknownKey,
+	errKeyFetchFailed, errInvalidSignature, errTokenExpired, errInvalidClaims,
+	errTokenInfoFailed, errIssuedInFuture, errEmailRequired,
+}
+
+// errorCategory returns the message of the sentinel error wrapped by
+// err, for use as a low-cardinality log field.
+func errorCategory(err error) string {
+	for _, sentinel := range verificationErrors {
+		if errors.Is(err, sentinel) {
+			return sentinel.Error()
+		}
+	}
+	return "unknown"
+}
+
+// classifyJWTError wraps an error from the jwt library's signature and
+// claims validation with the matching sentinel.
+func classifyJWTError(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return fmt.Errorf("%w: %w", errMalformedToken, err)
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return fmt.Errorf("%w: %w", errInvalidSignature, err)
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return fmt.Errorf("%w: %w", errTokenExpired, err)
+	default:
+		return fmt.Errorf("%w: %w", errInvalidClaims, err)
+	}
+}
+
+// deniedAlgs are rejected on every verification path, whatever the
+// path's own allowlist says. HMAC algorithms are confusable with RSA:
+// a token "signed" with the public key as an HMAC secret must never
+// verify.
+var deniedAlgs = map[string]bool{"HS256": true, "HS384": true, "HS512": true}
+
+// allowedAlgs returns algs minus any denied algorithm, for use as a
+// parser's list of valid methods.
+func allowedAlgs(algs ...string) []string {
+	allowed := make([]string, 0, len(algs))
+	for _, alg := range algs {
+		if !deniedAlgs[alg] {
+			allowed = append(allowed, alg)
+		}
+	}
+	return allowed
+}
+
+// checkTokenTyp rejects, with cfg.EnforceTokenTyp, a token whose typ
+// header is present but not "JWT", the type Google sets on both
+// Firebase and Google ID tokens.
+func checkTokenTyp(token *jwt.Token, cfg firebaseConfig) error {
+	if !cfg.EnforceTokenTyp {
+		return nil
+	}
+	if typ, ok := token.Header["typ"]; ok && typ != "JWT" {
+		return fmt.Errorf("%w: unexpected token type: %v", errMalformedToken, typ)
+	}
+	return nil
+}
+
+// idTokenAlgs returns the algorithms accepted for ID tokens: RS256,
+// which Google uses, plus PS256 when cfg.AllowPS256 is set. Both verify
+// against the same RSA public keys.
+func idTokenAlgs(cfg firebaseConfig) []string {
+	if cfg.AllowPS256 {
+		return []string{"RS256", "PS256"}
+	}
+	return []string{"RS256"}
+}
+
+// checkDeniedAlg decodes only the token header and rejects denied
+// algorithms before the rest of the token is parsed.
+func checkDeniedAlg(tokenString string) error {
+	segment, _, _ := strings.Cut(tokenString, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return fmt.Errorf("%w: decoding header: %w", errMalformedToken, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return fmt.Errorf("%w: parsing header: %w", errMalformedToken, err)
+	}
+	if deniedAlgs[header.Alg] {
+		return fmt.Errorf("%w: %s is denied", errUnsupportedAlg, header.Alg)
+	}
+	return nil
+}
+
+// Forms of the aud claim that cfg.AudForm can require. RFC 7519 allows
+// both; jwt.ClaimStrings accepts either without recording which it saw.
+const (
+	audFormString = "string"
+	audFormArray  = "array"
+)
+
+// checkAudForm rejects a token whose aud claim, in the base64url payload
+// segment, is not in the JSON form given (audFormString or
+// audFormArray). An empty form accepts both.
+func checkAudForm(payload, form string) error {
+	if form == "" {
+		return nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(payload, "="))
+	if err != nil {
+		return fmt.Errorf("%w: decoding payload: %w", errMalformedToken, err)
+	}
+	var claims struct {
+		Aud json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return fmt.Errorf("%w: parsing payload: %w", errMalformedToken, err)
+	}
+	got := ""
+	switch {
+	case len(claims.Aud) > 0 && claims.Aud[0] == '"':
+		got = audFormString
+	case len(claims.Aud) > 0 && claims.Aud[0] == '[':
+		got = audFormArray
+	}
+	if got != form {
+		return fmt.Errorf("%w: aud must be a JSON %s", errInvalidClaims, form)
+	}
+	return nil
+}
+
+type userClaims struct {
+	UID     string `json:"uid"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Picture string `json:"picture"`
+	Issuer  string `json:"issuer,omitempty"` // set for verified production tokens
+
+	// LinkedProviders lists the sign-in providers linked to the account,
+	// from the keys of the firebase.identities claim.
+	LinkedProviders []string `json:"linked_providers,omitempty"`
+
+	// ExpiresIn is the token's remaining validity in seconds when it was
+	// verified, so clients can schedule a refresh without decoding it.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// compactUserClaims is userClaims with empty optional attributes
+// omitted instead of sent as "", for OMIT_EMPTY_FIELDS. Its fields must
+// match userClaims' exactly, since userResponse converts between them.
+type compactUserClaims struct {
+	UID             string   `json:"uid"`
+	Email           string   `json:"email,omitempty"`
+	Name            string   `json:"name,omitempty"`
+	Picture         string   `json:"picture,omitempty"`
+	Issuer          string   `json:"issuer,omitempty"`
+	LinkedProviders []string `json:"linked_providers,omitempty"`
+	ExpiresIn       int64    `json:"expires_in,omitempty"`
+}
+
+// userResponse returns the JSON body for u: as is by default, which
+// existing clients rely on, or compact with cfg.OmitEmptyFields.
+func userResponse(u *userClaims, cfg firebaseConfig) any {
+	if cfg.OmitEmptyFields {
+		return (*compactUserClaims)(u)
+	}
+	return u
+}
+
+type firebaseClaims struct {
+	jwt.RegisteredClaims
+	Email    string       `json:"email"`
+	Name     string       `json:"name"`
+	Picture  string       `json:"picture"`
+	Firebase firebaseInfo `json:"firebase"`
+}
+
+// firebaseInfo is the "firebase" claim. Identities maps each linked
+// sign-in provider (e.g. "google.com", "password") to its identifiers.
+type firebaseInfo struct {
+	Identities map[string]any `json:"identities"`
+}
+
+// toUser returns the user profile carried by the claims.
+func (c *firebaseClaims) toUser() *userClaims {
+	var providers []string
+	for provider := range c.Firebase.Identities {
+		providers = append(providers, provider)
+	}
+	slices.Sort(providers)
+	return &userClaims{
+		UID:             c.Subject,
+		Email:           c.Email,
+		Name:            c.Name,
+		Picture:         c.Picture,
+		LinkedProviders: providers,
+		ExpiresIn:       int64(remainingValidity(c.ExpiresAt, time.Now()).Seconds()),
+	}
+}
+
+// remainingValidity returns how long until exp, or zero if exp is unset
+// or past.
+func remainingValidity(exp *jwt.NumericDate, now time.Time) time.Duration {
+	if exp == nil || !now.Before(exp.Time) {
+		return 0
+	}
+	return exp.Time.Sub(now)
+}
+
+// emulatorProbeTimeout bounds the startup emulator probe.
+const emulatorProbeTimeout = 2 * time.Second
+
+// probeEmulator checks that the Auth emulator at host answers HTTP. Any
+// response counts; only a connection failure or timeout is an error.
+func probeEmulator(host string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get("http://" + host + "/")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// verifyEmulatorToken parses an emulator token. The emulator normally
+// issues unsigned (alg:"none") tokens, which are accepted without
+// signature verification. When cfg.AuthEmulatorJWKS is set, signed
+// tokens are verified against the emulator's JWKS, falling back to the
+// unsigned path if the emulator doesn't serve one. cfg.EmulatorStrict
+// rejects everything but unsigned tokens, so a production token used
+// against the emulator by mistake fails loudly.
+func verifyEmulatorToken(ctx context.Context, tokenString string, cfg firebaseConfig) (*userClaims, error) {
+	if err := checkDeniedAlg(tokenString); err != nil {
+		return nil, err
+	}
+
+	if cfg.AuthEmulatorJWKS && !cfg.EmulatorStrict {
+		if user, ok, err := verifyEmulatorSignedToken(ctx, tokenString, cfg); ok {
+			return user, err
+		}
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(allowedAlgs("none", "RS256")),
+		jwt.WithoutClaimsValidation(),
+	)
+
+	token, _, err := parser.ParseUnverified(tokenString, &firebaseClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing emulator token: %w", errMalformedToken, err)
+	}
+	if cfg.EmulatorStrict && token.Method.Alg() != "none" {
+		return nil, fmt.Errorf("%w: %s (strict emulator mode accepts only unsigned tokens)", errUnsupportedAlg, token.Method.Alg())
+	}
+
+	claims, ok := token.Claims.(*firebaseClaims)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid emulator token claims", errInvalidClaims)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: emulator token subject (uid) is empty", errInvalidClaims)
+	}
+	if err := checkTimeClaims(&claims.RegisteredClaims, time.Now(), cfg); err != nil {
+		return nil, err
+	}
+
+	return claims.toUser(), nil
+}
+
+// verifyEmulatorSignedToken verifies a signed emulator token against the
+// emulator's JWKS. ok is false when the token is unsigned or the JWKS
+// can't be fetched, meaning the caller should use the unsigned path.
+func verifyEmulatorSignedToken(ctx context.Context, tokenString string, cfg firebaseConfig) (user *userClaims, ok bool, err error) {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &firebaseClaims{})
+	if err != nil || token.Method.Alg() != "RS256" {
+		return nil, false, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, false, nil
+	}
+
+	cache := emulatorKeyCache(cfg.AuthEmulatorHost)
+	pubKey, err := cache.getKey(ctx, kid)
+	if err != nil {
+		if cache.store.Expiry().IsZero() {
+			slog.Debug("emulator JWKS unavailable, accepting token unverified", "error", err.Error())
+			return nil, false, nil
+		}
+		return nil, true, err
+	}
+
+	verifiedToken, err := jwt.ParseWithClaims(tokenString, &firebaseClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return pubKey, nil
+	},
+		jwt.WithValidMethods(allowedAlgs("RS256")),
+		jwt.WithoutClaimsValidation(),
+	)
+	if err != nil {
+		return nil, true, fmt.Errorf("emulator token verification failed: %w", classifyJWTError(err))
+	}
+
+	claims := verifiedToken.Claims.(*firebaseClaims)
+	if claims.Subject == "" {
+		return nil, true, fmt.Errorf("%w: emulator token subject (uid) is empty", errInvalidClaims)
+	}
+	if err := checkTimeClaims(&claims.RegisteredClaims, time.Now(), cfg); err != nil {
+		return nil, true, err
+	}
+
+	return claims.toUser(), true, nil
+}
+
+// claimsValidator checks the claims of a token whose signature has
+// already been verified. Deployments with other policies (multiple
+// projects, custom OIDC issuers) can replace the default.
+type claimsValidator interface {
+	Validate(claims *firebaseClaims) error
+}
+
+// securetokenIssuerPrefix is the issuer of Firebase ID tokens, less the
+// project ID.
+const securetokenIssuerPrefix = "https://securetoken.google.com/"
+
+// projectClaimsValidator is the default policy: a non-empty subject,
+// and the issuer and audience of the Firebase project. Issuers widens
+// the accepted issuers, e.g. to both projects during a migration; a
+// token from an accepted securetoken issuer may then also carry that
+// issuer's project as its audience, as real tokens from the other
+// project do. Audiences widens the accepted audiences for any issuer.
+type projectClaimsValidator struct {
+	ProjectID string
+	Issuers   []string // empty = the project's securetoken issuer
+	Audiences []string // accepted in addition to ProjectID
+}
+
+func (v projectClaimsValidator) Validate(claims *firebaseClaims) error {
+	if claims.Subject == "" {
+		return fmt.Errorf("token subject (uid) is empty")
+	}
+
+	// Verify issuer
+	issuers := v.Issuers
+	if len(issuers) == 0 {
+		issuers = []string{securetokenIssuerPrefix + v.ProjectID}
+	}
+	if !slices.Contains(issuers, claims.Issuer) {
+		return fmt.Errorf("invalid issuer: got %q, want one of %q", claims.Issuer, issuers)
+	}
+
+	// Verify audience. jwt.ClaimStrings decodes both the array and the
+	// single-string form of aud; a string is one audience, never split.
+	if len(claims.Audience) == 0 {
+		return fmt.Errorf("invalid audience: audience is empty")
+	}
+	audiences := append([]string{v.ProjectID}, v.Audiences...)
+	// A token from another accepted Firebase project is minted for that
+	// project: its aud matches its iss.
+	if project, ok := strings.CutPrefix(claims.Issuer, securetokenIssuerPrefix); ok && project != "" {
+		audiences = append(audiences, project)
+	}
+	foundAud := false
+	for _, aud := range claims.Audience {
+		if slices.Contains(audiences, aud) {
+			foundAud = true
+			break
+		}
+	}
+	if !foundAud {
+		return fmt.Errorf("invalid audience: %v does not contain any of %q", claims.Audience, audiences)
+	}
+	return nil
+}
+
+// expectedExtraAudiences returns the audiences accepted besides the
+// project ID: the auth domain with cfg.AuthDomainAud, for proxies
+// and custom domains that mint tokens for it.
+func expectedExtraAudiences(cfg firebaseConfig) []string {
+	if cfg.AuthDomainAud && cfg.AuthDomain != "" {
+		return []string{cfg.AuthDomain}
+	}
+	return nil
+}
+
+// verifyPhases is how long each phase of verifyIDToken took, logged at
+// debug level to tell key fetch latency (network) from signature
+// verification (CPU). Phases after a failure are zero.
+type verifyPhases struct {
+	Parse, KeyLookup, Signature, Claims time.Duration
+}
+
+func (p *verifyPhases) log(err error) {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000.0 }
+	slog.Debug("token verification phases",
+		"parse_ms", ms(p.Parse),
+		"key_lookup_ms", ms(p.KeyLookup),
+		"signature_ms", ms(p.Signature),
+		"claims_ms", ms(p.Claims),
+		"ok", err == nil,
+	)
+}
+
+// googleKidPattern matches Google's key IDs: 40 hex characters (a SHA-1
+// fingerprint), allowing the base64url alphabet for safety.
+var googleKidPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{40}$`)
+
+// defaultMaxIssuedAtSkew is how far in the future a token's iat may be
+// before it is rejected. A larger gap means a broken clock or a forgery.
+const defaultMaxIssuedAtSkew = 5 * time.Minute
+
+// checkTimeClaims validates exp, iat and nbf against now, allowing
+// cfg.ClockSkewLeeway of drift between the issuer's clock and ours on
+// each of them.
+func checkTimeClaims(c *jwt.RegisteredClaims, now time.Time, cfg firebaseConfig) error {
+	leeway := cfg.ClockSkewLeeway
+	if c.ExpiresAt != nil && !now.Before(c.ExpiresAt.Time.Add(leeway)) {
+		return fmt.Errorf("%w: expired %s ago", errTokenExpired, now.Sub(c.ExpiresAt.Time).Round(time.Second))
+	}
+	maxSkew := cfg.MaxIssuedAtSkew
+	if maxSkew == 0 {
+		maxSkew = defaultMaxIssuedAtSkew
+	}
+	if c.IssuedAt != nil && c.IssuedAt.Time.After(now.Add(maxSkew+leeway)) {
+		return fmt.Errorf("%w: iat is %s ahead", errIssuedInFuture, c.IssuedAt.Time.Sub(now).Round(time.Second))
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(c.NotBefore.Time) {
+		return fmt.Errorf("%w: token not valid yet", errInvalidClaims)
+	}
+	return nil
+}
+
+func verifyIDToken(ctx context.Context, tokenString string, cfg firebaseConfig) (*userClaims, error) {
+	user, _, err := verifySignedIDToken(ctx, tokenString, cfg, false)
+	return user, err
+}
+
+// verifyLenient is verifyIDToken for callers that can make use of a
+// token with stale time claims, such as analytics: an expired, not yet
+// valid or future-dated token still yields its claims, with the
+// problems listed in warnings. Everything else (signature, key,
+// issuer, audience) is checked as strictly as by verifyIDToken. Never
+// use it to authenticate a request.
+func verifyLenient(ctx context.Context, tokenString string, cfg firebaseConfig) (user *userClaims, warnings []string, err error) {
+	return verifySignedIDToken(ctx, tokenString, cfg, true)
+}
+
+// verifySignedIDToken verifies a Firebase ID token signed with one of
+// Google's keys. With lenient set, time claim failures are returned as
+// warnings instead of errors.
+func verifySignedIDToken(ctx context.Context, tokenString string, cfg firebaseConfig, lenient bool) (user *userClaims, warnings []string, err error) {
+	var phases verifyPhases
+	mark := time.Now()
+	lap := func(d *time.Duration) {
+		now := time.Now()
+		*d, mark = now.Sub(mark), now
+	}
+	defer func() { phases.log(err) }()
+
+	if err := checkDeniedAlg(tokenString); err != nil {
+		return nil, nil, err
+	}
+
+	// Parse without verification first to get the key ID
+	token, parts, err := jwt.NewParser().ParseUnverified(tokenString, &firebaseClaims{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: parsing token: %w", errMalformedToken, err)
+	}
+
+	// Check algorithm
+	algs := idTokenAlgs(cfg)
+	if !slices.Contains(algs, token.Method.Alg()) {
+		return nil, nil, fmt.Errorf("%w: %s", errUnsupportedAlg, token.Method.Alg())
+	}
+
+	if err := checkTokenTyp(token, cfg); err != nil {
+		return nil, nil, err
+	}
+
+	// Get the key ID. A token without one is rejected outright; trying
+	// every cached key instead would let any of them vouch for it.
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, nil, fmt.Errorf("%w: missing kid in token header", errMissingKid)
+	}
+	if cfg.EnforceKidFormat && !googleKidPattern.MatchString(kid) {
+		return nil, nil, fmt.Errorf("%w: kid %q is not a 40-character Google key ID", errMalformedToken, kid)
+	}
+
+	lap(&phases.Parse)
+
+	// Fetch the public key
+	pubKey, err := keyCache.getKey(ctx, kid)
+	lap(&phases.KeyLookup)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyGeneration := keyCache.generation.Load()
+
+	// Parse and verify the token with the public key. Time claims are
+	// checked by checkTimeClaims rather than the jwt library, which
+	// rejects any iat in the future.
+	verifiedToken, err := jwt.ParseWithClaims(tokenString, &firebaseClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return pubKey, nil
+	},
+		jwt.WithValidMethods(allowedAlgs(algs...)),
+		jwt.WithoutClaimsValidation(),
+	)
+	lap(&phases.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("token verification failed: %w", classifyJWTError(err))
+	}
+
+	claims, ok := verifiedToken.Claims.(*firebaseClaims)
+	if !ok || !verifiedToken.Valid {
+		return nil, nil, fmt.Errorf("%w: invalid token claims", errInvalidClaims)
+	}
+
+	defer lap(&phases.Claims)
+	if err := checkAudForm(parts[1], cfg.AudForm); err != nil {
+		return nil, nil, err
+	}
+	if err := checkTimeClaims(&claims.RegisteredClaims, time.Now(), cfg); err != nil {
+		if !lenient {
+			return nil, nil, err
+		}
+		warnings = append(warnings, err.Error())
+	}
+
+	validator := cfg.ClaimsValidator
+	if validator == nil {
+		validator = projectClaimsValidator{ProjectID: cfg.ProjectID, Issuers: cfg.ValidIssuers, Audiences: expectedExtraAudiences(cfg)}
+	}
+	if err := validator.Validate(claims); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidClaims, err)
+	}
+
+	slog.Debug("token verified", "kid", kid, "key_generation", keyGeneration)
+	user = claims.toUser()
+	user.Issuer = claims.Issuer
+	return user, warnings, nil
+}
+
+// googleTokenInfoURL is Google's OAuth2 token introspection endpoint. A
+// variable so tests can point it at a mock.
+var googleTokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// verifyGoogleAccessToken validates a Google OAuth2 access token (not a
+// Firebase ID token) by asking Google's tokeninfo endpoint. Access
+// tokens are opaque, so there is no local signature or audience check.
+func verifyGoogleAccessToken(ctx context.Context, accessToken string) (*userClaims, error) {
+	form := url.Values{"access_token": {accessToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, googleTokenInfoURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errTokenInfoFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errTokenInfoFailed, err)
+	}
+	defer resp.Body.Close()
+
+	// tokeninfo answers 400 for invalid or expired tokens
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return nil, fmt.Errorf("%w: tokeninfo rejected the access token (status %d)", errInvalidClaims, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: tokeninfo returned status %d", errTokenInfoFailed, resp.StatusCode)
+	}
+
+	var info struct {
+		Sub       string `json:"sub"`
+		Email     string `json:"email"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("%w: parsing tokeninfo response: %w", errTokenInfoFailed, err)
+	}
+	expiresIn, err := strconv.Atoi(info.ExpiresIn)
+	if err != nil || expiresIn <= 0 {
+		return nil, fmt.Errorf("%w: access token has expired", errTokenExpired)
+	}
+	if info.Sub == "" {
+		return nil, fmt.Errorf("%w: access token subject is empty", errInvalidClaims)
+	}
+
+	return &userClaims{
+		UID:       info.Sub,
+		Email:     info.Email,
+		ExpiresIn: int64(expiresIn),
+	}, nil
+}
+
+// googleOAuthCertsURL is the JWKS of the keys signing Google-issued ID
+// tokens, such as those from Google One Tap / Sign in with Google.
+const googleOAuthCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// googleIssuers are the issuers of Google-issued ID tokens.
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+var googleIDKeyCache = &publicKeyCache{
+	url:   googleOAuthCertsURL,
+	parse: parseJWKS,
+	store: &memoryKeyStore{},
+}
+
+// isGoogleIssued reports whether an unverified token claims to be
+// issued by Google rather than Firebase.
+func isGoogleIssued(tokenString string) bool {
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &claims); err != nil {
+		return false
+	}
+	return slices.Contains(googleIssuers, claims.Issuer)
+}
+
+// verifyGoogleIDToken verifies a Google-issued ID token (One Tap, Sign
+// in with Google) against Google's OAuth2 keys. Its audience must be
+// cfg.GoogleClientID, the OAuth client the app signs in with.
+func verifyGoogleIDToken(ctx context.Context, tokenString string, cfg firebaseConfig) (*userClaims, error) {
+	if err := checkDeniedAlg(tokenString); err != nil {
+		return nil, err
+	}
+	token, parts, err := jwt.NewParser().ParseUnverified(tokenString, &firebaseClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing token: %w", errMalformedToken, err)
+	}
+	if token.Method.Alg() != "RS256" {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedAlg, token.Method.Alg())
+	}
+	if err := checkTokenTyp(token, cfg); err != nil {
+		return nil, err
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("%w: missing kid in token header", errMissingKid)
+	}
+
+	pubKey, err := googleIDKeyCache.getKey(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+	verifiedToken, err := jwt.ParseWithClaims(tokenString, &firebaseClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return pubKey, nil
+	},
+		jwt.WithValidMethods(allowedAlgs("RS256")),
+		jwt.WithoutClaimsValidation(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Google ID token verification failed: %w", classifyJWTError(err))
+	}
+
+	claims := verifiedToken.Claims.(*firebaseClaims)
+	if err := checkAudForm(parts[1], cfg.AudForm); err != nil {
+		return nil, err
+	}
+	if err := checkTimeClaims(&claims.RegisteredClaims, time.Now(), cfg); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(googleIssuers, claims.Issuer) {
+		return nil, fmt.Errorf("%w: invalid issuer %q for a Google ID token", errInvalidClaims, claims.Issuer)
+	}
+	if !slices.Contains(claims.Audience, cfg.GoogleClientID) {
+		return nil, fmt.Errorf("%w: invalid audience: %v does not contain %q", errInvalidClaims, claims.Audience, cfg.GoogleClientID)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: token subject is empty", errInvalidClaims)
+	}
+
+	user := claims.toUser()
+	user.Issuer = claims.Issuer
+	return user, nil
+}
+
+// defaultMaxTokenBytes bounds the token size accepted for parsing.
+// Firebase ID tokens are typically around 1KB.
+const defaultMaxTokenBytes = 8 << 10
+
+var (
+	errMissingToken      = errors.New("missing bearer token")
+	errInvalidAuthScheme = errors.New("unsupported authorization scheme")
+	errTokenTooLong      = errors.New("token exceeds maximum length")
+	errTokenNotJWT       = errors.New("token is not three base64url segments")
+)
+
+// checkTokenLength returns errTokenTooLong if the token is longer than
+// the configured maximum.
+func checkTokenLength(token string, cfg firebaseConfig) error {
+	limit := cfg.MaxTokenBytes
+	if limit <= 0 {
+		limit = defaultMaxTokenBytes
+	}
+	if len(token) > limit {
+		return errTokenTooLong
+	}
+	return nil
+}
+
+// checkTokenSegments returns errTokenNotJWT unless the token is three
+// dot-separated base64url segments, so obviously mangled tokens get a
+// clear error instead of a parser message. The signature segment may be
+// empty, as in the emulator's unsigned tokens.
+func checkTokenSegments(token string) error {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 || segments[0] == "" || segments[1] == "" {
+		return errTokenNotJWT
+	}
+	for _, seg := range segments {
+		if strings.TrimLeft(seg, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			return errTokenNotJWT
+		}
+	}
+	return nil
+}
+
+// extractToken returns the bearer token from the Authorization header,
+// or the bare token from cfg.AuthHeaderName when a gateway renames the
+// header. Surrounding whitespace from copy-pasted tokens is trimmed. It
+// returns errMissingToken when there is no token, errInvalidAuthScheme
+// when the header uses another scheme (e.g. Basic), errTokenTooLong when
+// the token is too long to be worth parsing and errTokenNotJWT when it
+// isn't shaped like a JWT.
+func extractToken(r *http.Request, cfg firebaseConfig) (string, error) {
+	var token string
+	if cfg.AuthHeaderName != "" {
+		token = r.Header.Get(cfg.AuthHeaderName)
+	} else {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			return "", errMissingToken
+		}
+		scheme, rest := splitAuthorization(authHeader)
+		if !strings.EqualFold(scheme, "Bearer") {
+			return "", errInvalidAuthScheme
+		}
+		token = rest
+	}
+
+	return checkExtractedToken(token, cfg)
+}
+
+// splitAuthorization splits an Authorization header value into its
+// scheme and credentials at the first run of spaces or tabs. RFC 7235
+// asks for a single space, but clients also send tabs or several
+// spaces.
+func splitAuthorization(header string) (scheme, credentials string) {
+	header = strings.TrimSpace(header)
+	i := strings.IndexAny(header, " \t")
+	if i < 0 {
+		return header, ""
+	}
+	return header[:i], strings.TrimLeft(header[i:], " \t")
+}
+
+// checkExtractedToken trims a token taken from a request and applies
+// the checks shared by all token sources.
+func checkExtractedToken(token string, cfg firebaseConfig) (string, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errMissingToken
+	}
+	if err := checkTokenLength(token, cfg); err != nil {
+		return "", err
+	}
+	if isDevBypassToken(token, cfg) {
+		return token, nil
+	}
+	if err := checkTokenSegments(token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// wsTokenProtocol is the WebSocket subprotocol announcing that the next
+// offered subprotocol is an ID token. Browsers can't set headers on a
+// WebSocket handshake, so clients pass the token as a subprotocol:
+//
+//	new WebSocket(url, ["bearer", idToken])
+const wsTokenProtocol = "bearer"
+
+// extractWebSocketToken returns the ID token offered in the
+// Sec-WebSocket-Protocol header of a WebSocket handshake, along with
+// the subprotocol the server must echo back in its own
+// Sec-WebSocket-Protocol header to accept the connection. Errors are
+// the same as extractToken's.
+func extractWebSocketToken(r *http.Request, cfg firebaseConfig) (token, subprotocol string, err error) {
+	var offered []string
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for p := range strings.SplitSeq(v, ",") {
+			offered = append(offered, strings.TrimSpace(p))
+		}
+	}
+	i := slices.Index(offered, wsTokenProtocol)
+	if i < 0 || i+1 >= len(offered) {
+		return "", "", errMissingToken
+	}
+	token, err = checkExtractedToken(offered[i+1], cfg)
+	if err != nil {
+		return "", "", err
+	}
+	return token, wsTokenProtocol, nil
+}
+
+// checkDevBypassAllowed returns an error if a development bypass token
+// may not be used in the environment named by ENV.
+func checkDevBypassAllowed(env string) error {
+	if strings.EqualFold(env, "production") {
+		return errors.New("DEV_BYPASS_TOKEN must not be set when ENV=production")
+	}
+	return nil
+}
+
+// isDevBypassToken reports whether token is the configured development
+// bypass token.
+func isDevBypassToken(token string, cfg firebaseConfig) bool {
+	return cfg.DevBypassToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.DevBypassToken)) == 1
+}
+
+// tokenVerifier verifies a bearer token and returns its user.
+type tokenVerifier interface {
+	Verify(ctx context.Context, token string) (*userClaims, error)
+}
+
+// verifyToken verifies a token with cfg.Verifier if set, otherwise with
+// the emulator or production verifier, depending on the configuration.
+// With cfg.GoogleClientID, Google-issued ID tokens are accepted too.
+// The development bypass token short-circuits both. With
+// cfg.RequireEmail, a valid token without an email fails with
+// errEmailRequired.
+func verifyToken(ctx context.Context, tokenString string, cfg firebaseConfig) (*userClaims, error) {
+	var user *userClaims
+	var err error
+	switch {
+	case cfg.Verifier != nil:
+		user, err = cfg.Verifier.Verify(ctx, tokenString)
+	case isDevBypassToken(tokenString, cfg):
+		user = &userClaims{UID: cfg.DevBypassUID, Email: cfg.DevBypassEmail}
+	case cfg.AuthEmulatorHost != "":
+		user, err = verifyEmulatorToken(ctx, tokenString, cfg)
+	case cfg.GoogleClientID != "" && isGoogleIssued(tokenString):
+		user, err = verifyGoogleIDToken(ctx, tokenString, cfg)
+	default:
+		user, err = verifyIDToken(ctx, tokenString, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RequireEmail && user.Email == "" {
+		return nil, fmt.Errorf("%w: token for %s has no email", errEmailRequired, user.UID)
+	}
+	return user, nil
+}
+
+// ──────────────────────────────────────────────
+// Batch Verification
+// ──────────────────────────────────────────────
+
+const (
+	batchMaxTokens = 100
+	batchWorkers   = 8
+	batchTimeout   = 10 * time.Second
+)
+
+type batchRequest struct {
+	Tokens []string `json:"tokens"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// batchResult holds either the verified claims or the error for one
+// token of a batch.
+type batchResult struct {
+	User  *userClaims  `json:"user,omitempty"`
+	Error *errorDetail `json:"error,omitempty"`
+}
+
+// compactBatchResult is batchResult with compactUserClaims.
+type compactBatchResult struct {
+	User  *compactUserClaims `json:"user,omitempty"`
+	Error *errorDetail       `json:"error,omitempty"`
+}
+
+// batchResponseFor returns the JSON body for results, rendering users
+// as userResponse does.
+func batchResponseFor(results []batchResult, cfg firebaseConfig) any {
+	if !cfg.OmitEmptyFields {
+		return batchResponse{Results: results}
+	}
+	compact := make([]compactBatchResult, len(results))
+	for i, res := range results {
+		compact[i] = compactBatchResult{User: (*compactUserClaims)(res.User), Error: res.Error}
+	}
+	return map[string]any{"results": compact}
+}
+
+// verifyBatch verifies tokens concurrently on at most workers
+// goroutines. Results are returned in input order; tokens not verified
+// before ctx is done are reported as DEADLINE_EXCEEDED.
+func verifyBatch(ctx context.Context, tokens []string, workers int, verify func(string) (*userClaims, error)) []batchResult {
+	type indexed struct {
+		i   int
+		res batchResult
+	}
+
+	jobs := make(chan int, len(tokens))
+	for i := range tokens {
+		jobs <- i
+	}
+	close(jobs)
+
+	// Buffered so workers never block once the collector has given up.
+	out := make(chan indexed, len(tokens))
+	for range min(workers, len(tokens)) {
+		go func() {
+			for i := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				user, err := verify(tokens[i])
+				if err != nil {
+					slog.Debug("batch token verification failed", "index", i, "error", err.Error())
+					out <- indexed{i, batchResult{Error: batchError(err)}}
+					continue
+				}
+				out <- indexed{i, batchResult{User: user}}
+			}
+		}()
+	}
+
+	results := make([]batchResult, len(tokens))
+	done := make([]bool, len(tokens))
+collect:
+	for range tokens {
+		select {
+		case r := <-out:
+			results[r.i] = r.res
+			done[r.i] = true
+		case <-ctx.Done():
+			break collect
+		}
+	}
+	for i := range results {
+		if !done[i] {
+			results[i] = batchResult{Error: &errorDetail{Code: codeDeadlineExceeded, Message: "Verification did not complete in time"}}
+		}
+	}
+	return results
+}
+
+// batchError returns the error reported for a token of a batch that
+// failed verification with err.
+func batchError(err error) *errorDetail {
+	switch {
+	case errors.Is(err, errEmailRequired):
+		return &errorDetail{Code: codeEmailRequired, Message: "Authentication token has no email address"}
+	case errors.Is(err, errMissingKid):
+		return &errorDetail{Code: codeMissingKid, Message: "Authentication token has no key ID"}
+	case errors.Is(err, errTokenTooLong):
+		return &errorDetail{Code: codeTokenTooLarge, Message: "Authentication token is too long"}
+	case errors.Is(err, errKeyFetchFailed):
+		return &errorDetail{Code: codeUnavailable, Message: "Unable to verify authentication token, try again later"}
+	default:
+		return &errorDetail{Code: codeUnauthenticated, Message: "Invalid authentication token"}
+	}
+}
+
+// ──────────────────────────────────────────────
+// JSON Helpers
+// ──────────────────────────────────────────────
+
+type errorEnvelope struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes used in error envelopes. ERROR_CODE_MAP can rename them to
+// match an organization-wide vocabulary.
+const (
+	codeUnauthenticated   = "UNAUTHENTICATED"
+	codeUnavailable       = "UNAVAILABLE"
+	codeInvalidArgument   = "INVALID_ARGUMENT"
+	codeInvalidAuthScheme = "INVALID_AUTH_SCHEME"
+	codeTokenTooLarge     = "TOKEN_TOO_LARGE"
+	codePayloadTooLarge   = "PAYLOAD_TOO_LARGE"
+	codeDeadlineExceeded  = "DEADLINE_EXCEEDED"
+	codeEmailRequired     = "EMAIL_REQUIRED"
+	codeNotFound          = "NOT_FOUND"
+	codeMissingKid        = "MISSING_KID"
+	codeInternal          = "INTERNAL"
+)
+
+var errorCodes = []string{
+	codeUnauthenticated, codeUnavailable, codeInvalidArgument, codeInvalidAuthScheme,
+	codeTokenTooLarge, codePayloadTooLarge, codeDeadlineExceeded, codeEmailRequired,
+	codeNotFound, codeMissingKid, codeInternal,
+}
+
+// errorCode returns the code to send for code, after cfg.ErrorCodes
+// overrides.
+func errorCode(code string, cfg firebaseConfig) string {
+	if override, ok := cfg.ErrorCodes[code]; ok {
+		return override
+	}
+	return code
+}
+
+// jsonOptions controls how writeJSONOpts encodes a response body.
+type jsonOptions struct {
+	EscapeHTML bool
+	Indent     string // empty = compact
+}
+
+var defaultJSONOptions = jsonOptions{EscapeHTML: true}
+
+// jsonOptionsFor derives the encoding options for a response from the
+// config and the request's ?pretty=1 debug flag.
+func jsonOptionsFor(r *http.Request, cfg firebaseConfig) jsonOptions {
+	opts := defaultJSONOptions
+	opts.EscapeHTML = !cfg.JSONNoEscapeHTML
+	if r.URL.Query().Get("pretty") == "1" {
+		opts.Indent = "  "
+	}
+	return opts
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
-	w.Header().Set("Content-Type", "application/json")
+	writeJSONOpts(w, status, v, defaultJSONOptions)
+}
+
+func writeJSONOpts(w http.ResponseWriter, status int, v any, opts jsonOptions) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(v)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(opts.EscapeHTML)
+	if opts.Indent != "" {
+		enc.SetIndent("", opts.Indent)
+	}
+	enc.Encode(v)
 }
 
-func writeError(w http.ResponseWriter, status int, code, message string) {
-	writeJSON(w, status, errorEnvelope{
-		Error: errorDetail{Code: code, Message: message},
-	})
+// writeError writes an error envelope, encoded with the same request
+// JSON options as a success response would be.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, cfg firebaseConfig) {
+	writeJSONOpts(w, status, errorEnvelope{
+		Error: errorDetail{Code: errorCode(code, cfg), Message: message},
+	}, jsonOptionsFor(r, cfg))
+}
+
+// maxJSONBodyBytes caps the size of JSON request bodies.
+const maxJSONBodyBytes = 1 << 20
+
+// decodeJSON decodes a single JSON value from the request body into dst,
+// rejecting oversized bodies (413), malformed JSON, unknown fields and
+// trailing data (400). It writes the error response itself and reports
+// whether decoding succeeded.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any, cfg firebaseConfig) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("request body must contain a single JSON value")
+	}
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+			fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit), cfg)
+		return false
+	}
+	writeError(w, r, http.StatusBadRequest, codeInvalidArgument, "Malformed JSON request body: "+err.Error(), cfg)
+	return false
+}
+
+// writeUnauthenticated writes the 401 error envelope along with the
+// RFC 6750 WWW-Authenticate challenge.
+func writeUnauthenticated(w http.ResponseWriter, r *http.Request, cfg firebaseConfig) {
+	writeUnauthenticatedMessage(w, r, "Missing or invalid authentication token", cfg)
+}
+
+// writeUnauthenticatedMessage is writeUnauthenticated with a more
+// specific message.
+func writeUnauthenticatedMessage(w http.ResponseWriter, r *http.Request, message string, cfg firebaseConfig) {
+	writeUnauthenticatedCode(w, r, codeUnauthenticated, message, cfg)
+}
+
+// writeUnauthenticatedCode is writeUnauthenticatedMessage with an error
+// code more specific than UNAUTHENTICATED.
+func writeUnauthenticatedCode(w http.ResponseWriter, r *http.Request, code, message string, cfg firebaseConfig) {
+	realm := cfg.AuthRealm
+	if realm == "" {
+		realm = cfg.ProjectID
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer realm="+strconv.Quote(realm))
+	writeError(w, r, http.StatusUnauthorized, code, message, cfg)
+}
+
+// writeMisconfigured writes a 503 naming the missing configuration in
+// misconfigured mode, and reports whether it did.
+func writeMisconfigured(w http.ResponseWriter, r *http.Request, cfg firebaseConfig) bool {
+	if len(cfg.MissingVars) == 0 {
+		return false
+	}
+	writeError(w, r, http.StatusServiceUnavailable, codeUnavailable,
+		"Server is misconfigured: missing "+strings.Join(cfg.MissingVars, ", "), cfg)
+	return true
 }
 
 // ──────────────────────────────────────────────
@@ -310,39 +2154,163 @@ func writeError(w http.ResponseWriter, status int, code, message string) {
 
 const firebaseSDKVersion = "11.3.0"
 
+const firebaseSDKBaseURL = "https://www.gstatic.com/firebasejs/" + firebaseSDKVersion
+
+// appCSS holds the styles shared by all pages, served at /static/app.css.
+const appCSS = `body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 600px; margin: 40px auto; padding: 0 20px; }
+.btn { padding: 10px 24px; font-size: 16px; border: none; border-radius: 6px; cursor: pointer; }
+.btn-signin { background: #4285f4; color: white; }
+.btn-signin:hover { background: #3367d6; }
+.btn-signout { background: #f44336; color: white; }
+.btn-signout:hover { background: #d32f2f; }
+.btn-profile { background: #4caf50; color: white; text-decoration: none; display: inline-block; }
+.btn-profile:hover { background: #388e3c; }
+.btn-home { background: #2196f3; color: white; text-decoration: none; display: inline-block; margin-top: 16px; margin-right: 8px; }
+.btn-home:hover { background: #1976d2; }
+.btn-retry { background: #ff9800; color: white; margin-top: 10px; }
+.btn-retry:hover { background: #f57c00; }
+#loading { color: #666; }
+#error-msg { color: #f44336; margin-top: 10px; display: none; }
+.config-banner { padding: 12px 16px; margin-bottom: 16px; background: #fff3e0; border: 1px solid #ffb74d; border-radius: 6px; }
+
+/* Home */
+.auth-section { margin-top: 20px; padding: 20px; border: 1px solid #ddd; border-radius: 8px; }
+.user-info { display: flex; align-items: center; gap: 12px; }
+
+/* Profile */
+.profile-card { padding: 24px; border: 1px solid #ddd; border-radius: 8px; }
+.profile-card .btn-signout { margin-top: 16px; }
+.profile-header { display: flex; align-items: center; gap: 16px; margin-bottom: 16px; }
+.profile-pic { width: 80px; height: 80px; border-radius: 50%; object-fit: cover; background: #e0e0e0; }
+.placeholder-pic { width: 80px; height: 80px; border-radius: 50%; background: #9e9e9e; display: flex; align-items: center; justify-content: center; color: white; font-size: 32px; }
+.profile-details { margin-top: 12px; }
+.profile-details dt { font-weight: bold; color: #555; margin-top: 8px; }
+.profile-details dd { margin-left: 0; }
+`
+
+// appJS initializes Firebase from the page's #firebase-config JSON and
+// exports the shared auth instance and Google provider. It is served at
+// /static/app.js; the config stays in the page so the script itself is
+// identical across deployments and can be cached.
+const appJS = `import { initializeApp } from "` + firebaseSDKBaseURL + `/firebase-app.js";
+import { getAuth, GoogleAuthProvider } from "` + firebaseSDKBaseURL + `/firebase-auth.js";
+
+const firebaseConfig = JSON.parse(document.getElementById("firebase-config").textContent);
+
+export const app = initializeApp(firebaseConfig);
+export const auth = getAuth(app);
+export const provider = new GoogleAuthProvider();
+`
+
+// staticAsset is a file served under /static/. Its URL carries a content
+// hash so it can be cached indefinitely and still change on deploy.
+type staticAsset struct {
+	path        string
+	contentType string
+	body        string
+}
+
+func (a staticAsset) url() string {
+	sum := sha256.Sum256([]byte(a.body))
+	return a.path + "?v=" + hex.EncodeToString(sum[:6])
+}
+
+var (
+	appCSSAsset = staticAsset{path: "/static/app.css", contentType: "text/css; charset=utf-8", body: appCSS}
+	appJSAsset  = staticAsset{path: "/static/app.js", contentType: "text/javascript; charset=utf-8", body: appJS}
+)
+
+// appPath returns the URL of an app path p such as "/profile" under
+// cfg.BasePath. The base path itself is the home page URL.
+func appPath(p string, cfg firebaseConfig) string {
+	if p == "/" && cfg.BasePath != "" {
+		return cfg.BasePath
+	}
+	return cfg.BasePath + p
+}
+
+// pageHead returns the shared <head> contents for a page titled title.
+func pageHead(title string, cfg firebaseConfig) string {
+	return `    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>` + title + `</title>
+    <link rel="stylesheet" href="` + appPath(appCSSAsset.url(), cfg) + `">`
+}
+
+// firebaseScripts returns the config JSON read by app.js, plus preload
+// hints so the SDK modules are fetched in parallel with app.js.
+func firebaseScripts(cfg firebaseConfig) string {
+	configJSON, _ := json.Marshal(map[string]string{
+		"apiKey":     cfg.APIKey,
+		"authDomain": cfg.AuthDomain,
+		"projectId":  cfg.ProjectID,
+	})
+	return `    <link rel="modulepreload" href="` + appPath(appJSAsset.url(), cfg) + `">
+    <link rel="modulepreload" href="` + firebaseSDKBaseURL + `/firebase-app.js">
+    <link rel="modulepreload" href="` + firebaseSDKBaseURL + `/firebase-auth.js">
+    <script type="application/json" id="firebase-config">` + string(configJSON) + `</script>`
+}
+
 // emulatorConnectSnippet returns JS to connect to the Firebase Auth
 // emulator after getAuth(). Empty string if not using emulator.
 func emulatorConnectSnippet(cfg firebaseConfig) string {
 	if cfg.AuthEmulatorHost == "" {
 		return ""
 	}
-	return "\n        connectAuthEmulator(auth, \"http://" + cfg.AuthEmulatorHost + "\", { disableWarnings: true });\n"
+	return "\n        connectAuthEmulator(auth, \"http://" + cfg.AuthEmulatorHost + "\", { disableWarnings: true });\n"
+}
+
+// jsString returns s as a JavaScript string literal that is also safe
+// to embed inside a <script> element.
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// providerSetupSnippet returns JS adding the configured OAuth scopes and
+// custom parameters (login_hint, hd) to the Google provider. Empty
+// string if none are configured.
+func providerSetupSnippet(cfg firebaseConfig) string {
+	var b strings.Builder
+	for _, scope := range cfg.GoogleScopes {
+		b.WriteString("        provider.addScope(" + jsString(scope) + ");\n")
+	}
+	params := map[string]string{}
+	if cfg.GoogleLoginHint != "" {
+		params["login_hint"] = cfg.GoogleLoginHint
+	}
+	if cfg.GoogleHostedDomain != "" {
+		params["hd"] = cfg.GoogleHostedDomain
+	}
+	if len(params) > 0 {
+		// json.Marshal escapes <, > and &, keeping the object safe
+		// inside <script>.
+		paramsJSON, _ := json.Marshal(params)
+		b.WriteString("        provider.setCustomParameters(" + string(paramsJSON) + ");\n")
+	}
+	return b.String()
+}
+
+// misconfiguredBanner returns a banner naming the missing configuration
+// in misconfigured mode. Empty string otherwise.
+func misconfiguredBanner(cfg firebaseConfig) string {
+	if len(cfg.MissingVars) == 0 {
+		return ""
+	}
+	return `    <div class="config-banner" role="alert">Configuration needed: set ` +
+		html.EscapeString(strings.Join(cfg.MissingVars, ", ")) + ` and restart the server. Sign-in is unavailable until then.</div>
+`
 }
 
 func homePage(cfg firebaseConfig) string {
 	return `<!DOCTYPE html>
 <html lang="en">
 <head>
-    <meta charset="utf-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <title>Hello, World!</title>
-    <style>
-        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 600px; margin: 40px auto; padding: 0 20px; }
-        .auth-section { margin-top: 20px; padding: 20px; border: 1px solid #ddd; border-radius: 8px; }
-        .user-info { display: flex; align-items: center; gap: 12px; }
-        .btn { padding: 10px 24px; font-size: 16px; border: none; border-radius: 6px; cursor: pointer; }
-        .btn-signin { background: #4285f4; color: white; }
-        .btn-signin:hover { background: #3367d6; }
-        .btn-signout { background: #f44336; color: white; }
-        .btn-signout:hover { background: #d32f2f; }
-        .btn-profile { background: #4caf50; color: white; text-decoration: none; display: inline-block; }
-        .btn-profile:hover { background: #388e3c; }
-        #loading { color: #666; }
-        #error-msg { color: #f44336; margin-top: 10px; display: none; }
-    </style>
+` + pageHead("Hello, World!", cfg) + `
+` + firebaseScripts(cfg) + `
 </head>
 <body>
-    <h1>Hello, World!</h1>
+` + misconfiguredBanner(cfg) + `    <h1>Hello, World!</h1>
 
     <div class="auth-section">
         <div id="loading">Loading...</div>
@@ -355,7 +2323,7 @@ func homePage(cfg firebaseConfig) string {
                 <span>Welcome, <strong id="user-name"></strong></span>
             </div>
             <div style="margin-top: 12px; display: flex; gap: 8px;">
-                <a href="/profile" class="btn btn-profile">View Profile</a>
+                <a href="` + appPath("/profile", cfg) + `" class="btn btn-profile">View Profile</a>
                 <button class="btn btn-signout" id="signout-btn">Sign out</button>
             </div>
         </div>
@@ -363,19 +2331,9 @@ func homePage(cfg firebaseConfig) string {
     </div>
 
     <script type="module">
-        import { initializeApp } from "https://www.gstatic.com/firebasejs/` + firebaseSDKVersion + `/firebase-app.js";
-        import { getAuth, connectAuthEmulator, signInWithPopup, GoogleAuthProvider, onAuthStateChanged, signOut } from "https://www.gstatic.com/firebasejs/` + firebaseSDKVersion + `/firebase-auth.js";
-
-        const firebaseConfig = {
-            apiKey: "` + cfg.APIKey + `",
-            authDomain: "` + cfg.AuthDomain + `",
-            projectId: "` + cfg.ProjectID + `"
-        };
-
-        const app = initializeApp(firebaseConfig);
-        const auth = getAuth(app);
-` + emulatorConnectSnippet(cfg) + `        const provider = new GoogleAuthProvider();
-
+        import { auth, provider } from "` + appPath(appJSAsset.url(), cfg) + `";
+        import { connectAuthEmulator, signInWithPopup, onAuthStateChanged, signOut } from "` + firebaseSDKBaseURL + `/firebase-auth.js";
+` + emulatorConnectSnippet(cfg) + providerSetupSnippet(cfg) + `
         const loadingEl = document.getElementById("loading");
         const signedOutEl = document.getElementById("signed-out");
         const signedInEl = document.getElementById("signed-in");
@@ -419,33 +2377,29 @@ func homePage(cfg firebaseConfig) string {
 </html>`
 }
 
+// referrerPolicies are the valid Referrer-Policy values.
+var referrerPolicies = []string{
+	"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+	"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url",
+}
+
+// avatarReferrerPolicy returns the referrerpolicy for profile pictures.
+func avatarReferrerPolicy(cfg firebaseConfig) string {
+	if cfg.AvatarReferrerPolicy == "" {
+		return "no-referrer"
+	}
+	return cfg.AvatarReferrerPolicy
+}
+
 func profilePage(cfg firebaseConfig) string {
 	return `<!DOCTYPE html>
 <html lang="en">
 <head>
-    <meta charset="utf-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <title>Profile</title>
-    <style>
-        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 600px; margin: 40px auto; padding: 0 20px; }
-        .profile-card { padding: 24px; border: 1px solid #ddd; border-radius: 8px; }
-        .profile-header { display: flex; align-items: center; gap: 16px; margin-bottom: 16px; }
-        .profile-pic { width: 80px; height: 80px; border-radius: 50%; object-fit: cover; background: #e0e0e0; }
-        .placeholder-pic { width: 80px; height: 80px; border-radius: 50%; background: #9e9e9e; display: flex; align-items: center; justify-content: center; color: white; font-size: 32px; }
-        .profile-details { margin-top: 12px; }
-        .profile-details dt { font-weight: bold; color: #555; margin-top: 8px; }
-        .profile-details dd { margin-left: 0; }
-        .btn { padding: 10px 24px; font-size: 16px; border: none; border-radius: 6px; cursor: pointer; }
-        .btn-signout { background: #f44336; color: white; margin-top: 16px; }
-        .btn-signout:hover { background: #d32f2f; }
-        .btn-home { background: #2196f3; color: white; text-decoration: none; display: inline-block; margin-top: 16px; margin-right: 8px; }
-        .btn-home:hover { background: #1976d2; }
-        #loading { color: #666; }
-        #error-msg { color: #f44336; margin-top: 10px; display: none; }
-    </style>
+` + pageHead("Profile", cfg) + `
+` + firebaseScripts(cfg) + `
 </head>
 <body>
-    <h1>Profile</h1>
+` + misconfiguredBanner(cfg) + `    <h1>Profile</h1>
 
     <div id="loading">Loading profile...</div>
     <div id="profile-card" class="profile-card" style="display:none">
@@ -461,29 +2415,21 @@ func profilePage(cfg firebaseConfig) string {
             <dd id="profile-uid"></dd>
         </dl>
         <div>
-            <a href="/" class="btn btn-home">Home</a>
+            <a href="` + appPath("/", cfg) + `" class="btn btn-home">Home</a>
             <button class="btn btn-signout" id="signout-btn">Sign out</button>
         </div>
     </div>
     <div id="error-msg"></div>
+    <button class="btn btn-retry" id="retry-btn" style="display:none">Retry</button>
 
     <script type="module">
-        import { initializeApp } from "https://www.gstatic.com/firebasejs/` + firebaseSDKVersion + `/firebase-app.js";
-        import { getAuth, connectAuthEmulator, signInWithPopup, GoogleAuthProvider, onAuthStateChanged, signOut } from "https://www.gstatic.com/firebasejs/` + firebaseSDKVersion + `/firebase-auth.js";
-
-        const firebaseConfig = {
-            apiKey: "` + cfg.APIKey + `",
-            authDomain: "` + cfg.AuthDomain + `",
-            projectId: "` + cfg.ProjectID + `"
-        };
-
-        const app = initializeApp(firebaseConfig);
-        const auth = getAuth(app);
-` + emulatorConnectSnippet(cfg) + `        const provider = new GoogleAuthProvider();
-
+        import { auth, provider } from "` + appPath(appJSAsset.url(), cfg) + `";
+        import { connectAuthEmulator, signInWithPopup, onAuthStateChanged, signOut } from "` + firebaseSDKBaseURL + `/firebase-auth.js";
+` + emulatorConnectSnippet(cfg) + providerSetupSnippet(cfg) + `
         const loadingEl = document.getElementById("loading");
         const profileCard = document.getElementById("profile-card");
         const errorEl = document.getElementById("error-msg");
+        const retryBtn = document.getElementById("retry-btn");
 
         onAuthStateChanged(auth, async (user) => {
             if (!user) {
@@ -504,14 +2450,32 @@ func profilePage(cfg firebaseConfig) string {
             }
 
             // Authenticated — fetch profile from API
+            await loadProfile(user);
+        });
+
+        // loadProfile fetches and renders the profile. A 503 UNAVAILABLE
+        // is transient (the server couldn't fetch signing keys), so it
+        // offers a retry instead of an error.
+        async function loadProfile(user) {
+            errorEl.style.display = "none";
+            retryBtn.style.display = "none";
+            loadingEl.textContent = "Loading profile...";
+            loadingEl.style.display = "block";
             try {
                 const idToken = await user.getIdToken();
-                const resp = await fetch("/api/me", {
+                const resp = await fetch("` + appPath("/api/me", cfg) + `", {
                     headers: { "Authorization": "Bearer " + idToken }
                 });
 
                 if (!resp.ok) {
-                    const errData = await resp.json();
+                    const errData = await resp.json().catch(() => ({}));
+                    if (resp.status === 503 && errData.error?.code === ` + jsString(errorCode(codeUnavailable, cfg)) + `) {
+                        errorEl.textContent = "The server can't verify your sign-in right now. Please try again.";
+                        errorEl.style.display = "block";
+                        retryBtn.style.display = "inline-block";
+                        loadingEl.style.display = "none";
+                        return;
+                    }
                     throw new Error(errData.error?.message || "Failed to load profile");
                 }
 
@@ -522,7 +2486,7 @@ func profilePage(cfg firebaseConfig) string {
 
                 const picContainer = document.getElementById("pic-container");
                 if (profile.picture) {
-                    picContainer.innerHTML = '<img class="profile-pic" src="' + profile.picture + '" alt="Profile picture" referrerpolicy="no-referrer">';
+                    picContainer.innerHTML = '<img class="profile-pic" src="' + profile.picture + '" alt="Profile picture" referrerpolicy="` + avatarReferrerPolicy(cfg) + `">';
                 } else {
                     const initial = (profile.name || "?")[0].toUpperCase();
                     picContainer.innerHTML = '<div class="placeholder-pic">' + initial + '</div>';
@@ -535,6 +2499,12 @@ func profilePage(cfg firebaseConfig) string {
                 errorEl.style.display = "block";
                 loadingEl.style.display = "none";
             }
+        }
+
+        retryBtn.addEventListener("click", () => {
+            if (auth.currentUser) {
+                loadProfile(auth.currentUser);
+            }
         });
 
         document.getElementById("signout-btn").addEventListener("click", async () => {
@@ -551,60 +2521,412 @@ func profilePage(cfg firebaseConfig) string {
 </html>`
 }
 
+func notFoundPage(cfg firebaseConfig) string {
+	return `<!DOCTYPE html>
+<html lang="en">
+<head>
+` + pageHead("Page not found", cfg) + `
+</head>
+<body>
+    <h1>Page not found</h1>
+    <p>The page you were looking for doesn't exist.</p>
+    <a href="` + appPath("/", cfg) + `" class="btn btn-home">Home</a>
+</body>
+</html>`
+}
+
+// htmlETag returns a strong ETag over the build version and a rendered
+// page, so either a template change or a new deploy yields a new tag.
+func htmlETag(version, body string) string {
+	sum := sha256.Sum256([]byte(version + "\x00" + body))
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveHTML writes a rendered page with its ETag and Cache-Control,
+// answering a matching If-None-Match with 304 Not Modified. HEAD gets
+// the same headers as GET and no body.
+func serveHTML(w http.ResponseWriter, r *http.Request, body string, cfg firebaseConfig) {
+	etag := htmlETag(cfg.BuildVersion, body)
+	w.Header().Set("ETag", etag)
+	if cfg.HTMLMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(cfg.HTMLMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		fmt.Fprint(w, body)
+	}
+}
+
+// wantsHTML reports whether the client prefers an HTML response, i.e.
+// it is a browser navigation rather than an API call.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// healthResponse mirrors grpc.health.v1.HealthCheckResponse.
+type healthResponse struct {
+	Status string `json:"status"` // SERVING or NOT_SERVING
+}
+
+// ──────────────────────────────────────────────
+// Admin
+// ──────────────────────────────────────────────
+
+// isAdminRequest reports whether r carries the admin bearer token.
+func isAdminRequest(r *http.Request, cfg firebaseConfig) bool {
+	scheme, token := splitAuthorization(r.Header.Get("Authorization"))
+	return cfg.AdminToken != "" && strings.EqualFold(scheme, "Bearer") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(cfg.AdminToken)) == 1
+}
+
+// maskSecret hides all but the last four characters of a secret.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// effectiveConfig describes the running configuration for operators,
+// with defaults resolved and secrets masked.
+func effectiveConfig(cfg firebaseConfig) map[string]any {
+	maxTokenBytes := cfg.MaxTokenBytes
+	if maxTokenBytes <= 0 {
+		maxTokenBytes = defaultMaxTokenBytes
+	}
+	maxIatSkew := cfg.MaxIssuedAtSkew
+	if maxIatSkew == 0 {
+		maxIatSkew = defaultMaxIssuedAtSkew
+	}
+	return map[string]any{
+		"project_id":             cfg.ProjectID,
+		"api_key":                maskSecret(cfg.APIKey),
+		"auth_domain":            cfg.AuthDomain,
+		"auth_emulator_host":     cfg.AuthEmulatorHost,
+		"auth_realm":             cmp.Or(cfg.AuthRealm, cfg.ProjectID),
+		"auth_header_name":       cmp.Or(cfg.AuthHeaderName, "Authorization"),
+		"base_path":              cfg.BasePath,
+		"build_version":          cfg.BuildVersion,
+		"log_format":             cmp.Or(cfg.LogFormat, "json"),
+		"log_sample_rate":        max(cfg.LogSampleRate, 1),
+		"max_token_bytes":        maxTokenBytes,
+		"max_iat_skew":           maxIatSkew.String(),
+		"max_cached_keys":        cmp.Or(cfg.MaxCachedKeys, defaultMaxCachedKeys),
+		"cold_start_wait":        cfg.ColdStartWait.String(),
+		"unknown_kid_ttl":        cfg.UnknownKidTTL.String(),
+		"clock_skew_leeway":      cfg.ClockSkewLeeway.String(),
+		"aud_form":               cmp.Or(cfg.AudForm, "any"),
+		"valid_issuers":          cfg.ValidIssuers,
+		"google_scopes":          cfg.GoogleScopes,
+		"google_hd":              cfg.GoogleHostedDomain,
+		"google_client_id":       cfg.GoogleClientID,
+		"google_certs_file":      cfg.GoogleCertsFile,
+		"avatar_referrer_policy": avatarReferrerPolicy(cfg),
+		"html_max_age":           cfg.HTMLMaxAge.String(),
+		"root_redirect":          cfg.RootRedirect,
+		"error_codes":            cfg.ErrorCodes,
+		"missing_vars":           cfg.MissingVars,
+		"strip_request_headers":  cfg.StripHeaders,
+		"features": map[string]bool{
+			"emulator":            cfg.AuthEmulatorHost != "",
+			"emulator_jwks":       cfg.AuthEmulatorJWKS,
+			"emulator_strict":     cfg.EmulatorStrict,
+			"emulator_probe":      cfg.EmulatorProbe,
+			"api_only":            cfg.APIOnly,
+			"json_escape_html":    !cfg.JSONNoEscapeHTML,
+			"omit_empty_fields":   cfg.OmitEmptyFields,
+			"enforce_token_typ":   cfg.EnforceTokenTyp,
+			"enforce_kid_format":  cfg.EnforceKidFormat,
+			"require_email":       cfg.RequireEmail,
+			"auth_domain_aud":     cfg.AuthDomainAud,
+			"allow_ps256":         cfg.AllowPS256,
+			"log_request_headers": cfg.LogReqHeaders,
+			"dev_bypass_token":    cfg.DevBypassToken != "",
+			"custom_validator":    cfg.ClaimsValidator != nil,
+			"custom_verifier":     cfg.Verifier != nil,
+			"error_reporter":      cfg.ErrorReporter != nil,
+		},
+	}
+}
+
+// checkRedirectTarget accepts an absolute http or https URL with a host,
+// or a path on this site. Protocol-relative ("//host") and
+// backslash-prefixed paths are refused, since browsers resolve them to
+// another site, as are schemes like javascript:.
+func checkRedirectTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		if u.Host == "" {
+			return errors.New("URL has no host")
+		}
+	case u.Scheme != "":
+		return fmt.Errorf("scheme %q is not http or https", u.Scheme)
+	case !strings.HasPrefix(target, "/"):
+		return errors.New("must be an http(s) URL or start with /")
+	case strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\"):
+		return errors.New("protocol-relative paths lead off-site")
+	}
+	return nil
+}
+
 // ──────────────────────────────────────────────
 // Router Setup (extracted for testability)
 // ──────────────────────────────────────────────
 
-func newMux(cfg firebaseConfig) *http.ServeMux {
+func newMux(cfg firebaseConfig) http.Handler {
 	mux := http.NewServeMux()
 
-	// GET / — Home page with Hello, World! and auth UI
-	homeHTML := homePage(cfg)
-	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, homeHTML)
-	})
+	// The HTML UI: pages, their preflight answers and static assets.
+	// API_ONLY deployments serve none of it.
+	if !cfg.APIOnly {
+		// GET / — Home page with Hello, World! and auth UI, or a redirect
+		// to ROOT_REDIRECT
+		homeHTML := homePage(cfg)
+		mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+			if cfg.RootRedirect != "" {
+				http.Redirect(w, r, cfg.RootRedirect, http.StatusFound)
+				return
+			}
+			serveHTML(w, r, homeHTML, cfg)
+		})
+
+		// OPTIONS / and /profile — Advertise the methods the HTML routes accept
+		for _, pattern := range []string{"OPTIONS /{$}", "OPTIONS /profile"} {
+			mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+				w.WriteHeader(http.StatusNoContent)
+			})
+		}
 
-	// GET /profile — Profile page
-	profileHTML := profilePage(cfg)
-	mux.HandleFunc("GET /profile", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, profileHTML)
-	})
+		// GET /static/* — Shared CSS and JS, cacheable indefinitely since
+		// pages reference them by content hash
+		for _, asset := range []staticAsset{appCSSAsset, appJSAsset} {
+			mux.HandleFunc("GET "+asset.path, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", asset.contentType)
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, asset.body)
+			})
+		}
+
+		// GET /profile — Profile page
+		profileHTML := profilePage(cfg)
+		mux.HandleFunc("GET /profile", func(w http.ResponseWriter, r *http.Request) {
+			serveHTML(w, r, profileHTML, cfg)
+		})
+	}
 
 	// GET /api/me — Authenticated user profile (JSON)
 	mux.HandleFunc("GET /api/me", func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			writeError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "Missing or invalid authentication token")
+		if writeMisconfigured(w, r, cfg) {
+			return
+		}
+		tokenString, err := extractToken(r, cfg)
+		if errors.Is(err, errInvalidAuthScheme) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidAuthScheme, "Authorization header must use the Bearer scheme", cfg)
+			return
+		}
+		if errors.Is(err, errTokenTooLong) {
+			writeError(w, r, http.StatusBadRequest, codeTokenTooLarge, "Authentication token is too long", cfg)
+			return
+		}
+		if errors.Is(err, errTokenNotJWT) {
+			writeUnauthenticatedMessage(w, r, "Authentication token must be a JWT: three base64url segments separated by dots", cfg)
+			return
+		}
+		if err != nil {
+			writeUnauthenticated(w, r, cfg)
 			return
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		var user *userClaims
-		var err error
-		if cfg.AuthEmulatorHost != "" {
-			user, err = verifyEmulatorToken(tokenString, cfg.ProjectID)
-		} else {
-			user, err = verifyIDToken(tokenString, cfg.ProjectID)
+		user, err := verifyToken(r.Context(), tokenString, cfg)
+		if errors.Is(err, errKeyFetchFailed) {
+			slog.Error("token verification unavailable", "category", errorCategory(err), "error", err.Error())
+			reportError(r.Context(), err, cfg)
+			writeError(w, r, http.StatusServiceUnavailable, codeUnavailable, "Unable to verify authentication token, try again later", cfg)
+			return
+		}
+		if errors.Is(err, errMissingKid) {
+			slog.Warn("token verification failed", "category", errorCategory(err), "error", err.Error())
+			writeUnauthenticatedCode(w, r, codeMissingKid, "Authentication token has no key ID (kid) header", cfg)
+			return
+		}
+		if errors.Is(err, errEmailRequired) {
+			writeError(w, r, http.StatusForbidden, codeEmailRequired, "Authentication token has no email address; sign in with an account that has one", cfg)
+			return
 		}
 		if err != nil {
-			slog.Warn("token verification failed", "error", err.Error())
-			writeError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "Missing or invalid authentication token")
+			slog.Warn("token verification failed", "category", errorCategory(err), "error", err.Error())
+			writeUnauthenticated(w, r, cfg)
 			return
 		}
 
-		writeJSON(w, http.StatusOK, user)
+		writeJSONOpts(w, http.StatusOK, userResponse(user, cfg), jsonOptionsFor(r, cfg))
 	})
 
-	// Catch-all 404
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// POST /api/verify/batch — Verify many tokens at once (JSON)
+	mux.HandleFunc("POST /api/verify/batch", func(w http.ResponseWriter, r *http.Request) {
+		if writeMisconfigured(w, r, cfg) {
+			return
+		}
+		var req batchRequest
+		if !decodeJSON(w, r, &req, cfg) {
+			return
+		}
+		if len(req.Tokens) == 0 || len(req.Tokens) > batchMaxTokens {
+			writeError(w, r, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("tokens must contain between 1 and %d entries", batchMaxTokens), cfg)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), batchTimeout)
+		defer cancel()
+		results := verifyBatch(ctx, req.Tokens, batchWorkers, func(tok string) (*userClaims, error) {
+			if err := checkTokenLength(tok, cfg); err != nil {
+				return nil, err
+			}
+			return verifyToken(ctx, tok, cfg)
+		})
+		for _, result := range results {
+			if result.Error != nil {
+				result.Error.Code = errorCode(result.Error.Code, cfg)
+			}
+		}
+		writeJSONOpts(w, http.StatusOK, batchResponseFor(results, cfg), jsonOptionsFor(r, cfg))
+	})
+
+	// GET /health — Serving status in the shape of the gRPC health
+	// protocol: 200 SERVING once the signing keys are loaded, 503
+	// NOT_SERVING otherwise or when misconfigured
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.MissingVars) > 0 || (cfg.AuthEmulatorHost == "" && !keyCache.ready(r.Context())) {
+			writeJSONOpts(w, http.StatusServiceUnavailable, healthResponse{Status: "NOT_SERVING"}, jsonOptionsFor(r, cfg))
+			return
+		}
+		writeJSONOpts(w, http.StatusOK, healthResponse{Status: "SERVING"}, jsonOptionsFor(r, cfg))
+	})
+
+	// GET /version — Build version, commit and Go version
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONOpts(w, http.StatusOK, currentVersion(), jsonOptionsFor(r, cfg))
+	})
+
+	// GET /admin/config — Effective configuration, secrets masked
+	if cfg.AdminToken != "" {
+		mux.HandleFunc("GET /admin/config", func(w http.ResponseWriter, r *http.Request) {
+			if !isAdminRequest(r, cfg) {
+				writeUnauthenticated(w, r, cfg)
+				return
+			}
+			writeJSONOpts(w, http.StatusOK, effectiveConfig(cfg), jsonOptionsFor(r, cfg))
+		})
+	}
+
+	// GET /metrics — Prometheus metrics
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeKeyCacheMetrics(w, keyCache)
+		requestsByRoute.write(w, "http_requests_total", "HTTP requests by matched route pattern.")
+		responsesByRoute.write(w, "http_responses_total", "HTTP responses by matched route pattern and status class.")
+		fmt.Fprintf(w, "# HELP notfound_total Requests answered 404 by the catch-all handler.\n# TYPE notfound_total counter\nnotfound_total %d\n", notFoundTotal.Load())
+	})
+
+	// Catch-all 404 — friendly page for browsers, empty body otherwise.
+	// OPTIONS gets a JSON 404 under /api/ and a 204 under the static
+	// asset prefix, whose paths vary with the content hash. 404s are
+	// counted in notFoundTotal and marked so loggingMiddleware logs them
+	// at debug level only, so scanners don't drown the info logs.
+	// Requests outside BASE_PATH get the same 404.
+	notFoundHTML := notFoundPage(cfg)
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notFoundTotal.Add(1)
+		markNotFound(r.Context())
+		if r.Method == http.MethodOptions && strings.HasPrefix(r.URL.Path, "/api/") {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "No API endpoint at "+r.URL.Path, cfg)
+			return
+		}
+		if !cfg.APIOnly && wantsHTML(r) && !strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, notFoundHTML)
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && !cfg.APIOnly && strings.HasPrefix(r.URL.Path, "/static/") {
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		notFound(w, r)
+	})
+
+	counted := countRoutes(mux)
+	if cfg.BasePath != "" {
+		return mountAt(cfg.BasePath, counted, notFound)
+	}
+	return counted
+}
+
+// newHandler wraps newMux in the middleware the server runs it with.
+func newHandler(cfg firebaseConfig) http.Handler {
+	return stripHeadersMiddleware(loggingMiddleware(recoveryMiddleware(rejectMethodsMiddleware(trailingSlashMiddleware(newMux(cfg))), cfg), cfg), cfg)
+}
+
+// countRoutes counts requests served by mux in requestsByRoute, under
+// their routeLabel, and records the matched pattern for
+// loggingMiddleware.
+func countRoutes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		label := routeLabel(r)
+		requestsByRoute.inc(label)
+		if label != unmatchedRoute {
+			recordRoute(r.Context(), label)
+		}
+	})
+}
 
-	return mux
+// mountAt serves h under prefix: prefix itself is h's "/" and
+// prefix+"/rest" is h's "/rest". Paths outside prefix are served by
+// notFound.
+func mountAt(prefix string, h, notFound http.Handler) *http.ServeMux {
+	strip := http.StripPrefix(prefix, h)
+	outer := http.NewServeMux()
+	outer.Handle(prefix+"/", strip)
+	outer.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = prefix+"/", ""
+		strip.ServeHTTP(w, r)
+	})
+	outer.Handle("/", notFound)
+	return outer
 }
 
 // ──────────────────────────────────────────────
@@ -618,17 +2940,42 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	if err := reloadLogLevel(); err != nil {
+		slog.Error("invalid log level", "error", err.Error())
+		os.Exit(1)
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       &logLevel,
+		ReplaceAttr: prefixAttrKeys(os.Getenv("LOG_KEY_PREFIX")),
+	}))
 	slog.SetDefault(logger)
+	go watchLogLevelSignal()
 
 	cfg := loadFirebaseConfig()
+	keyCache.maxKeys = cfg.MaxCachedKeys
+	keyCache.unknownKidTTL = cfg.UnknownKidTTL
+	if cfg.GoogleCertsFile != "" {
+		keyCache.url = "file://" + cfg.GoogleCertsFile
+		keyCache.fileTTL = cfg.GoogleCertsFileTTL
+		slog.Warn("loading Google public keys from a local file", "path", cfg.GoogleCertsFile)
+	}
+	if cfg.ColdStartWait > 0 && cfg.AuthEmulatorHost == "" {
+		keyCache.coldStartWait = cfg.ColdStartWait
+		keyCache.warmup(context.Background())
+	}
 
-	mux := newMux(cfg)
+	if cfg.AuthEmulatorHost != "" && cfg.EmulatorProbe {
+		if err := probeEmulator(cfg.AuthEmulatorHost, emulatorProbeTimeout); err != nil {
+			slog.Warn("Firebase Auth emulator is unreachable; sign-in and token checks will fail until it is up",
+				"host", cfg.AuthEmulatorHost, "error", err.Error())
+		}
+	}
 
-	handler := loggingMiddleware(mux)
+	handler := newHandler(cfg)
 
 	addr := ":" + port
-	slog.Info("server starting", "addr", addr)
+	version := currentVersion()
+	slog.Info("server starting", "addr", addr, "version", version.Version, "commit", version.Commit, "go_version", version.GoVersion)
 
 	if err := http.ListenAndServe(addr, handler); err != nil {
 		slog.Error("server failed", "error", err.Error())
@@ -636,37 +2983,377 @@ func main() {
 	}
 }
 
+// ──────────────────────────────────────────────
+// Log Level
+// ──────────────────────────────────────────────
+
+// logLevel is referenced by the default handler, so changing it takes
+// effect immediately without rebuilding the logger.
+var logLevel slog.LevelVar
+
+// reloadLogLevel sets logLevel from the file named by LOG_LEVEL_FILE
+// (e.g. a mounted config map) if set, otherwise from LOG_LEVEL. Unset
+// means info.
+func reloadLogLevel() error {
+	value := os.Getenv("LOG_LEVEL")
+	if path := os.Getenv("LOG_LEVEL_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading LOG_LEVEL_FILE: %w", err)
+		}
+		value = strings.TrimSpace(string(b))
+	}
+	level := slog.LevelInfo
+	if value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("parsing log level %q: %w", value, err)
+		}
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+// prefixAttrKeys returns a ReplaceAttr function namespacing attribute
+// keys with prefix (e.g. "app." turns "status" into "app.status") so they
+// don't collide with fields added by the log platform. The built-in time,
+// level, msg and source keys are left alone, as are groups, which slog
+// doesn't pass to ReplaceAttr. An empty prefix returns nil.
+func prefixAttrKeys(prefix string) func(groups []string, a slog.Attr) slog.Attr {
+	if prefix == "" {
+		return nil
+	}
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) > 0 {
+			return a
+		}
+		switch a.Key {
+		case slog.TimeKey, slog.LevelKey, slog.MessageKey, slog.SourceKey:
+			return a
+		}
+		a.Key = prefix + a.Key
+		return a
+	}
+}
+
+// watchLogLevelSignal reloads the log level on every SIGHUP.
+func watchLogLevelSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := reloadLogLevel(); err != nil {
+			slog.Error("log level reload failed", "error", err.Error())
+			continue
+		}
+		slog.Info("log level reloaded", "level", logLevel.Level().String())
+	}
+}
+
 // ──────────────────────────────────────────────
 // Logging Middleware
 // ──────────────────────────────────────────────
 
+// responseCapture records the status a handler sent. Like net/http, it
+// treats a Write without WriteHeader as an implicit 200 and ignores (with
+// a warning) any WriteHeader after the first, so the log shows the status
+// the client actually received.
 type responseCapture struct {
 	http.ResponseWriter
-	status int
+	status      int
+	wroteHeader bool
+	bytes       int // body bytes written
 }
 
 func (rc *responseCapture) WriteHeader(code int) {
-	rc.status = code
+	if rc.wroteHeader {
+		slog.Warn("superfluous WriteHeader call ignored", "status", code, "sent_status", rc.status)
+		return
+	}
+	if code >= 200 {
+		// 1xx informational responses may precede the final status.
+		rc.status = code
+		rc.wroteHeader = true
+	}
 	rc.ResponseWriter.WriteHeader(code)
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	var counter uint64
+func (rc *responseCapture) Write(b []byte) (int, error) {
+	if !rc.wroteHeader {
+		rc.WriteHeader(http.StatusOK)
+	}
+	n, err := rc.ResponseWriter.Write(b)
+	rc.bytes += n
+	return n, err
+}
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying the request ID id.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID carried by ctx, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// slowRequestThreshold is the latency above which a request is always
+// logged, regardless of sampling.
+const slowRequestThreshold = time.Second
+
+// loggedRequestHeaders are the only headers LOG_REQUEST_HEADERS logs.
+// Credentials (Authorization, Cookie) must never be added.
+var loggedRequestHeaders = []string{"User-Agent", "Origin", "Referer"}
+
+// accessLogWriter receives access log lines in the "clf" log format.
+var accessLogWriter io.Writer = os.Stdout
+
+// combinedLogLine formats a request in the Combined Log Format used by
+// Apache and NGINX access logs.
+func combinedLogLine(r *http.Request, status, bytes int, start time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.Itoa(bytes)
+	}
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s",
+		host,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(r.Method+" "+r.RequestURI+" "+r.Proto),
+		status,
+		size,
+		quote(r.Referer()),
+		quote(r.UserAgent()),
+	)
+}
+
+// loggingMiddleware logs one line per request, as JSON via slog or, with
+// cfg.LogFormat "clf", as a Combined Log Format line on accessLogWriter.
+// With cfg.LogSampleRate set to N, only 1 in N fast 2xx requests is
+// logged; other requests are always logged. 404s from the catch-all
+// handler are logged at debug level in JSON, but always in CLF, which
+// has no levels.
+func loggingMiddleware(next http.Handler, cfg firebaseConfig) http.Handler {
+	var counter, sampled atomic.Uint64
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		counter++
-		requestID := fmt.Sprintf("%d-%d", start.UnixNano(), counter)
+		requestID := fmt.Sprintf("%d-%d", start.UnixNano(), counter.Add(1))
+		ctx, route := withRouteSlot(withRequestID(r.Context(), requestID))
+		r = r.WithContext(ctx)
+
+		if cfg.LogReqHeaders {
+			attrs := []any{"request_id", requestID}
+			for _, name := range loggedRequestHeaders {
+				if v := r.Header.Get(name); v != "" {
+					attrs = append(attrs, strings.ToLower(name), v)
+				}
+			}
+			slog.Debug("request headers", attrs...)
+		}
 
 		rc := &responseCapture{ResponseWriter: w, status: http.StatusOK}
 		next.ServeHTTP(rc, r)
 
 		latency := time.Since(start)
-		slog.Info("request",
+		// Requests answered before reaching the mux (redirects, rejected
+		// methods) have no route.
+		responsesByRoute.inc(cmp.Or(route.pattern, unmatchedRoute), statusClass(rc.status))
+
+		success := rc.status >= 200 && rc.status < 300
+		if cfg.LogSampleRate > 1 && success && latency < slowRequestThreshold &&
+			sampled.Add(1)%uint64(cfg.LogSampleRate) != 1 {
+			return
+		}
+		if cfg.LogFormat == "clf" {
+			fmt.Fprintln(accessLogWriter, combinedLogLine(r, rc.status, rc.bytes, start))
+			return
+		}
+		level := slog.LevelInfo
+		if route.notFound {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "request",
 			"request_id", requestID,
 			"method", r.Method,
 			"path", r.URL.Path,
+			"route", route.pattern,
 			"status", rc.status,
 			"latency_ms", float64(latency.Microseconds())/1000.0,
+			"latency_seconds", latency.Seconds(),
+			"latency_human", latency.Round(time.Microsecond).String(),
 		)
 	})
 }
+
+// ──────────────────────────────────────────────
+// Error Reporting
+// ──────────────────────────────────────────────
+
+// errorReporter forwards server-side failures to an error tracker such
+// as Sentry. ReportError must not block the request for long.
+type errorReporter interface {
+	ReportError(ctx context.Context, err error)
+}
+
+// reportError passes err to cfg.ErrorReporter, if any.
+func reportError(ctx context.Context, err error, cfg firebaseConfig) {
+	if cfg.ErrorReporter != nil {
+		cfg.ErrorReporter.ReportError(ctx, err)
+	}
+}
+
+// errorReportClient bounds how long a report may take.
+var errorReportClient = &http.Client{Timeout: 5 * time.Second}
+
+// webhookErrorReporter is an example reporter: it POSTs each error as
+// {"error": "...", "time": "..."} to url in the background, e.g. to an
+// error tracker's ingestion endpoint or a relay in front of one.
+type webhookErrorReporter struct {
+	url string
+}
+
+func (r webhookErrorReporter) ReportError(ctx context.Context, err error) {
+	body, _ := json.Marshal(map[string]string{
+		"error": err.Error(),
+		"time":  time.Now().UTC().Format(time.RFC3339),
+	})
+	go func() {
+		resp, err := errorReportClient.Post(r.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Warn("error report failed", "error", err.Error())
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// ──────────────────────────────────────────────
+// Panic Recovery
+// ──────────────────────────────────────────────
+
+// recoveryMiddleware turns a panicking handler into a 500 error envelope
+// and reports the panic, instead of net/http's dropped connection.
+func recoveryMiddleware(next http.Handler, cfg firebaseConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			err := fmt.Errorf("panic serving %s %s: %v", r.Method, r.URL.Path, rec)
+			slog.Error("handler panicked", "error", err.Error(), "stack", string(debug.Stack()))
+			reportError(r.Context(), err, cfg)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error", cfg)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ──────────────────────────────────────────────
+// Inbound Header Stripping
+// ──────────────────────────────────────────────
+
+// parseProxyPrefix parses a TRUSTED_PROXIES entry: a CIDR, or a single
+// IP meaning just that address.
+func parseProxyPrefix(v string) (netip.Prefix, error) {
+	if strings.Contains(v, "/") {
+		return netip.ParsePrefix(v)
+	}
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// fromTrustedProxy reports whether r's peer is one of cfg.TrustedProxies.
+func fromTrustedProxy(r *http.Request, cfg firebaseConfig) bool {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	return slices.ContainsFunc(cfg.TrustedProxies, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// stripHeadersMiddleware removes cfg.StripHeaders (e.g. X-Forwarded-For
+// or X-Request-Id) from requests not sent by a trusted proxy, so clients
+// can't spoof headers that only the proxy is supposed to set.
+func stripHeadersMiddleware(next http.Handler, cfg firebaseConfig) http.Handler {
+	if len(cfg.StripHeaders) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fromTrustedProxy(r, cfg) {
+			for _, name := range cfg.StripHeaders {
+				r.Header.Del(name)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ──────────────────────────────────────────────
+// Rejected Methods
+// ──────────────────────────────────────────────
+
+// rejectedMethods are refused on every route: TRACE echoes requests
+// back (cross-site tracing) and CONNECT asks for a tunnel, neither of
+// which this server offers.
+var rejectedMethods = []string{http.MethodTrace, http.MethodConnect}
+
+// rejectMethodsMiddleware answers rejectedMethods with 405 before they
+// reach any handler, whatever the path.
+func rejectMethodsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(rejectedMethods, r.Method) {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ──────────────────────────────────────────────
+// Trailing Slash Middleware
+// ──────────────────────────────────────────────
+
+// trailingSlashMiddleware redirects non-root paths ending in "/" to
+// their canonical form, e.g. /api/me/ → /api/me. GET and HEAD get a 301;
+// other methods get a 308 so the method and body are preserved.
+func trailingSlashMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" || !strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The escaped path keeps %3F, %20 and the like encoded, so they
+		// don't turn into a query or a broken Location. path.Clean also
+		// collapses a leading "//", which would otherwise turn the
+		// Location into a protocol-relative (off-site) URL.
+		target := path.Clean(r.URL.EscapedPath())
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, status)
+	})
+}
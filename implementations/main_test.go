@@ -1,13 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -30,9 +47,11 @@ func generateTestKey(t *testing.T, kid string) *rsa.PrivateKey {
 	if err != nil {
 		t.Fatalf("generating RSA key: %v", err)
 	}
+	keyCache.store.Set(map[string]*rsa.PublicKey{kid: &privKey.PublicKey}, time.Now().Add(1*time.Hour))
+	// Mark the set as just fetched so unknown kids don't force a refresh
+	// against Google's real endpoint.
 	keyCache.mu.Lock()
-	keyCache.keys = map[string]*rsa.PublicKey{kid: &privKey.PublicKey}
-	keyCache.expiry = time.Now().Add(1 * time.Hour)
+	keyCache.lastRefresh = time.Now()
 	keyCache.mu.Unlock()
 	return privKey
 }
@@ -64,6 +83,35 @@ func validClaims() firebaseClaims {
 	}
 }
 
+// newCertServer serves pub as a Google-style kid → PEM certificate map.
+func newCertServer(t *testing.T, kid string, priv *rsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	certPEM := testCertPEM(t, priv)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		writeJSON(w, http.StatusOK, map[string]string{kid: certPEM})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testCertPEM returns a self-signed PEM certificate for priv, shaped like
+// the ones Google serves.
+func testCertPEM(t *testing.T, priv *rsa.PrivateKey) string {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "securetoken.system.gserviceaccount.com"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
 func newTestServer() *httptest.Server {
 	return httptest.NewServer(newMux(testCfg))
 }
@@ -194,6 +242,116 @@ func TestHomePage_HasFirebaseSDK(t *testing.T) {
 	}
 }
 
+func TestHomePage_HEAD(t *testing.T) {
+	mux := newMux(testCfg)
+	get := httptest.NewRecorder()
+	mux.ServeHTTP(get, httptest.NewRequest("GET", "/", nil))
+
+	head := httptest.NewRecorder()
+	mux.ServeHTTP(head, httptest.NewRequest("HEAD", "/", nil))
+	if head.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", head.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD body has %d bytes, want 0", head.Body.Len())
+	}
+	for _, h := range []string{"Content-Type", "Content-Length", "ETag", "Cache-Control"} {
+		if got, want := head.Header().Get(h), get.Header().Get(h); got != want || got == "" {
+			t.Errorf("HEAD %s = %q, GET has %q", h, got, want)
+		}
+	}
+	if ct := head.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestHomePage_ETagChangesWithBuildVersion(t *testing.T) {
+	etag := func(version string) string {
+		cfg := testCfg
+		cfg.BuildVersion = version
+		rec := httptest.NewRecorder()
+		newMux(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Header().Get("ETag")
+	}
+	v1, v1Again, v2 := etag("v1"), etag("v1"), etag("v2")
+	if v1 == "" {
+		t.Fatal("missing ETag")
+	}
+	if v1 != v1Again {
+		t.Errorf("ETag not stable for one version: %s vs %s", v1, v1Again)
+	}
+	if v1 == v2 {
+		t.Errorf("ETag %s unchanged across build versions", v1)
+	}
+}
+
+func TestHomePage_RootRedirect(t *testing.T) {
+	cfg := testCfg
+	cfg.RootRedirect = "https://dashboard.example.com/home"
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want 302", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != cfg.RootRedirect {
+		t.Errorf("Location = %q, want %q", loc, cfg.RootRedirect)
+	}
+
+	rec = httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Hello, World!") {
+		t.Errorf("unset: status = %d, want the home page", rec.Code)
+	}
+}
+
+func TestCheckRedirectTarget(t *testing.T) {
+	for target, ok := range map[string]bool{
+		"https://dashboard.example.com": true,
+		"http://example.com/path?q=1":   true,
+		"/profile":                      true,
+		"https:///no-host":              false,
+		"javascript:alert(1)":           false,
+		"//evil.example.com":            false,
+		`/\evil.example.com`:            false,
+		"dashboard":                     false,
+	} {
+		if err := checkRedirectTarget(target); (err == nil) != ok {
+			t.Errorf("checkRedirectTarget(%q) = %v, want ok = %v", target, err, ok)
+		}
+	}
+}
+
+func TestHomePage_IfNoneMatch304(t *testing.T) {
+	mux := newMux(testCfg)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	etag := rec.Header().Get("ETag")
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", cc)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status = %d, want 304", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("304 body = %q, want empty", rec.Body.String())
+	}
+}
+
+func TestHomePage_HTMLMaxAge(t *testing.T) {
+	cfg := testCfg
+	cfg.HTMLMaxAge = 5 * time.Minute
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=300" {
+		t.Errorf("Cache-Control = %q, want max-age=300", cc)
+	}
+}
+
 // ── GET /profile ────────────────────────────────
 
 func TestProfilePage_Status200(t *testing.T) {
@@ -296,6 +454,93 @@ func TestProfilePage_AutoSignIn(t *testing.T) {
 	}
 }
 
+func TestProfilePage_RetryOnUnavailable(t *testing.T) {
+	page := profilePage(testCfg)
+	for _, want := range []string{
+		`id="retry-btn"`,
+		`resp.status === 503 && errData.error?.code === "UNAVAILABLE"`,
+		`loadProfile(auth.currentUser)`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("profile page missing %s", want)
+		}
+	}
+
+	cfg := testCfg
+	cfg.ErrorCodes = map[string]string{codeUnavailable: "TRY_AGAIN"}
+	if !strings.Contains(profilePage(cfg), `errData.error?.code === "TRY_AGAIN"`) {
+		t.Error("retry check should use the mapped error code")
+	}
+}
+
+func TestProfilePage_AvatarReferrerPolicy(t *testing.T) {
+	if !strings.Contains(profilePage(testCfg), `referrerpolicy="no-referrer"`) {
+		t.Error("default policy should be no-referrer")
+	}
+	cfg := testCfg
+	cfg.AvatarReferrerPolicy = "strict-origin-when-cross-origin"
+	page := profilePage(cfg)
+	if !strings.Contains(page, `referrerpolicy="strict-origin-when-cross-origin"`) {
+		t.Error("configured policy missing from the profile page")
+	}
+	if strings.Contains(page, `referrerpolicy="no-referrer"`) {
+		t.Error("default policy still present")
+	}
+}
+
+// ── GET /static/* ───────────────────────────────
+
+func TestStaticAssets_ServedWithCaching(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	for _, tc := range []struct{ path, contentType, want string }{
+		{"/static/app.css", "text/css; charset=utf-8", ".btn-signin"},
+		{"/static/app.js", "text/javascript; charset=utf-8", "initializeApp"},
+	} {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: status = %d, want 200", tc.path, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("%s: Content-Type = %q, want %q", tc.path, ct, tc.contentType)
+		}
+		if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "max-age=31536000") {
+			t.Errorf("%s: Cache-Control = %q, want long-lived max-age", tc.path, cc)
+		}
+		if !strings.Contains(string(body), tc.want) {
+			t.Errorf("%s: body missing %q", tc.path, tc.want)
+		}
+	}
+}
+
+func TestPages_ReferenceStaticAssets(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	for _, path := range []string{"/", "/profile"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		s := string(body)
+		if !strings.Contains(s, `href="`+appCSSAsset.url()+`"`) {
+			t.Errorf("%s: missing stylesheet link to %s", path, appCSSAsset.url())
+		}
+		if !strings.Contains(s, `from "`+appJSAsset.url()+`"`) {
+			t.Errorf("%s: missing import of %s", path, appJSAsset.url())
+		}
+		if strings.Contains(s, "<style>") {
+			t.Errorf("%s: styles should come from app.css, not an inline <style>", path)
+		}
+	}
+}
+
 // ── GET /api/me ─────────────────────────────────
 
 func TestAPIMe_NoAuth_401(t *testing.T) {
@@ -319,8 +564,8 @@ func TestAPIMe_NoAuth_ErrorEnvelope(t *testing.T) {
 		t.Fatalf("GET /api/me: %v", err)
 	}
 	defer resp.Body.Close()
-	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
-		t.Errorf("Content-Type = %q, want application/json", ct)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want application/json; charset=utf-8", ct)
 	}
 	var env errorEnvelope
 	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
@@ -334,6 +579,35 @@ func TestAPIMe_NoAuth_ErrorEnvelope(t *testing.T) {
 	}
 }
 
+func TestAPIMe_NoAuth_WWWAuthenticateDefaultRealm(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/me")
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	want := `Bearer realm="` + testProjectID + `"`
+	if got := resp.Header.Get("WWW-Authenticate"); got != want {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, want)
+	}
+}
+
+func TestAPIMe_NoAuth_WWWAuthenticateConfiguredRealm(t *testing.T) {
+	cfg := testCfg
+	cfg.AuthRealm = "tabular"
+	srv := httptest.NewServer(newMux(cfg))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/me")
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("WWW-Authenticate"); got != `Bearer realm="tabular"` {
+		t.Errorf("WWW-Authenticate = %q, want Bearer realm=\"tabular\"", got)
+	}
+}
+
 func TestAPIMe_InvalidToken_401(t *testing.T) {
 	srv := newTestServer()
 	defer srv.Close()
@@ -349,7 +623,22 @@ func TestAPIMe_InvalidToken_401(t *testing.T) {
 	}
 }
 
-func TestAPIMe_BasicAuth_401(t *testing.T) {
+func TestAPIMe_BasicAuth_400(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestAPIMe_BasicAuth_InvalidAuthScheme(t *testing.T) {
 	srv := newTestServer()
 	defer srv.Close()
 	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
@@ -359,11 +648,205 @@ func TestAPIMe_BasicAuth_401(t *testing.T) {
 		t.Fatalf("GET /api/me: %v", err)
 	}
 	defer resp.Body.Close()
+	var env errorEnvelope
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if env.Error.Code != "INVALID_AUTH_SCHEME" {
+		t.Errorf("code = %q, want INVALID_AUTH_SCHEME", env.Error.Code)
+	}
+}
+
+func TestAPIMe_EmptyBearer_401(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 401 {
 		t.Errorf("status = %d, want 401", resp.StatusCode)
 	}
 }
 
+func TestAPIMe_OversizedToken_400(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+strings.Repeat("a", defaultMaxTokenBytes+1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+	var env errorEnvelope
+	json.NewDecoder(resp.Body).Decode(&env)
+	if env.Error.Code != "TOKEN_TOO_LARGE" {
+		t.Errorf("code = %q, want TOKEN_TOO_LARGE", env.Error.Code)
+	}
+}
+
+func TestExtractToken_ConfiguredMax(t *testing.T) {
+	cfg := testCfg
+	cfg.MaxTokenBytes = 10
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer 12345678901")
+	if _, err := extractToken(r, cfg); !errors.Is(err, errTokenTooLong) {
+		t.Errorf("err = %v, want errTokenTooLong", err)
+	}
+	r.Header.Set("Authorization", "Bearer 12.456.890")
+	if _, err := extractToken(r, cfg); err != nil {
+		t.Errorf("token at the limit should be accepted: %v", err)
+	}
+}
+
+func TestExtractToken_DefaultBearer(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer abc.def.ghi")
+	r.Header.Set("X-Id-Token", "ignored")
+	tok, err := extractToken(r, testCfg)
+	if err != nil || tok != "abc.def.ghi" {
+		t.Errorf("extractToken = %q, %v; want abc.def.ghi", tok, err)
+	}
+}
+
+func TestExtractToken_TrailingNewlineTrimmed(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header["Authorization"] = []string{"Bearer abc.def.ghi\n"}
+	tok, err := extractToken(r, testCfg)
+	if err != nil || tok != "abc.def.ghi" {
+		t.Errorf("extractToken = %q, %v; want abc.def.ghi", tok, err)
+	}
+}
+
+func TestExtractToken_WhitespaceAfterScheme(t *testing.T) {
+	for _, header := range []string{"Bearer\tabc.def.ghi", "Bearer   abc.def.ghi", "Bearer \t abc.def.ghi", "bearer\t\tabc.def.ghi"} {
+		r := httptest.NewRequest("GET", "/api/me", nil)
+		r.Header["Authorization"] = []string{header}
+		tok, err := extractToken(r, testCfg)
+		if err != nil || tok != "abc.def.ghi" {
+			t.Errorf("%q: extractToken = %q, %v; want abc.def.ghi", header, tok, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer")
+	if _, err := extractToken(r, testCfg); !errors.Is(err, errMissingToken) {
+		t.Errorf("scheme only: err = %v, want errMissingToken", err)
+	}
+}
+
+func TestExtractToken_WrongSegmentCount(t *testing.T) {
+	for _, tok := range []string{"abc.def", "abc.def.ghi.jkl", "abc.d$f.ghi", ".def.ghi"} {
+		r := httptest.NewRequest("GET", "/api/me", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		if _, err := extractToken(r, testCfg); !errors.Is(err, errTokenNotJWT) {
+			t.Errorf("%q: err = %v, want errTokenNotJWT", tok, err)
+		}
+	}
+}
+
+func TestAPIMe_NotAJWT_401Message(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer abc.def")
+	rec := httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+	var env errorEnvelope
+	json.Unmarshal(rec.Body.Bytes(), &env)
+	if !strings.Contains(env.Error.Message, "three base64url segments") {
+		t.Errorf("message = %q, want the segment explanation", env.Error.Message)
+	}
+}
+
+func TestExtractToken_CustomHeader(t *testing.T) {
+	cfg := testCfg
+	cfg.AuthHeaderName = "X-Id-Token"
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("X-Id-Token", "abc.def.ghi")
+	r.Header.Set("Authorization", "Bearer ignored")
+	tok, err := extractToken(r, cfg)
+	if err != nil || tok != "abc.def.ghi" {
+		t.Errorf("extractToken = %q, %v; want abc.def.ghi", tok, err)
+	}
+
+	r.Header.Del("X-Id-Token")
+	if _, err := extractToken(r, cfg); !errors.Is(err, errMissingToken) {
+		t.Errorf("err = %v, want errMissingToken without the custom header", err)
+	}
+}
+
+func TestExtractWebSocketToken(t *testing.T) {
+	kid := "key-ws"
+	privKey := generateTestKey(t, kid)
+	idToken := signToken(t, privKey, kid, validClaims())
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Protocol", "bearer, "+idToken)
+	tok, proto, err := extractWebSocketToken(r, testCfg)
+	if err != nil || tok != idToken || proto != "bearer" {
+		t.Fatalf("extractWebSocketToken = %q, %q, %v; want the token and bearer", tok, proto, err)
+	}
+	if user, err := verifyIDToken(context.Background(), tok, testCfg); err != nil || user.UID != "user-uid-abc123" {
+		t.Errorf("verifyIDToken = %+v, %v", user, err)
+	}
+
+	// The offer may also be split across several headers.
+	r.Header.Del("Sec-WebSocket-Protocol")
+	r.Header.Add("Sec-WebSocket-Protocol", "chat.v1, bearer")
+	r.Header.Add("Sec-WebSocket-Protocol", idToken)
+	if tok, _, err := extractWebSocketToken(r, testCfg); err != nil || tok != idToken {
+		t.Errorf("split headers: extractWebSocketToken = %q, %v", tok, err)
+	}
+}
+
+func TestExtractWebSocketToken_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   error
+	}{
+		{"", errMissingToken},
+		{"chat.v1", errMissingToken},
+		{"bearer", errMissingToken},
+		{"bearer, abc.def", errTokenNotJWT},
+	} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if tc.header != "" {
+			r.Header.Set("Sec-WebSocket-Protocol", tc.header)
+		}
+		if _, _, err := extractWebSocketToken(r, testCfg); !errors.Is(err, tc.want) {
+			t.Errorf("%q: err = %v, want %v", tc.header, err, tc.want)
+		}
+	}
+}
+
+func TestAPIMe_CustomHeader_200(t *testing.T) {
+	cfg := testCfg
+	cfg.AuthHeaderName = "X-Id-Token"
+	srv := httptest.NewServer(newMux(cfg))
+	defer srv.Close()
+	kid := "key-custom-header"
+	privKey := generateTestKey(t, kid)
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
+	req.Header.Set("X-Id-Token", signToken(t, privKey, kid, validClaims()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
 func TestAPIMe_ValidToken_200(t *testing.T) {
 	srv := newTestServer()
 	defer srv.Close()
@@ -399,6 +882,120 @@ func TestAPIMe_ValidToken_200(t *testing.T) {
 	}
 }
 
+func TestAPIMe_RequireEmail(t *testing.T) {
+	cfg := testCfg
+	cfg.RequireEmail = true
+	kid := "key-require-email"
+	privKey := generateTestKey(t, kid)
+	phoneUser := validClaims()
+	phoneUser.Email = ""
+
+	for _, tc := range []struct {
+		name   string
+		claims firebaseClaims
+		want   int
+	}{
+		{"with email", validClaims(), http.StatusOK},
+		{"without email", phoneUser, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", "Bearer "+signToken(t, privKey, kid, tc.claims))
+		rec := httptest.NewRecorder()
+		newMux(cfg).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d; body = %s", tc.name, rec.Code, tc.want, rec.Body)
+		}
+		if tc.want == http.StatusForbidden {
+			var env errorEnvelope
+			json.Unmarshal(rec.Body.Bytes(), &env)
+			if env.Error.Code != codeEmailRequired {
+				t.Errorf("%s: code = %q, want %s", tc.name, env.Error.Code, codeEmailRequired)
+			}
+		}
+	}
+
+	// Emailless tokens are accepted by default.
+	if _, err := verifyToken(context.Background(), signToken(t, privKey, kid, phoneUser), testCfg); err != nil {
+		t.Errorf("default policy: verifyToken = %v, want an emailless token accepted", err)
+	}
+}
+
+func TestAPIMe_EmptyOptionalFields(t *testing.T) {
+	kid := "key-empty-fields"
+	privKey := generateTestKey(t, kid)
+	c := validClaims()
+	c.Email, c.Name, c.Picture = "", "", ""
+	tok := signToken(t, privKey, kid, c)
+
+	for _, tc := range []struct {
+		omit    bool
+		present bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		cfg := testCfg
+		cfg.OmitEmptyFields = tc.omit
+		req := httptest.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		newMux(cfg).ServeHTTP(rec, req)
+
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if body["uid"] != "user-uid-abc123" {
+			t.Errorf("omit=%v: uid = %v", tc.omit, body["uid"])
+		}
+		for _, key := range []string{"email", "name", "picture"} {
+			v, ok := body[key]
+			if ok != tc.present || (ok && v != "") {
+				t.Errorf("omit=%v: %s = %v (present %v), want present = %v", tc.omit, key, v, ok, tc.present)
+			}
+		}
+	}
+}
+
+// fakeVerifier accepts the tokens it maps, returning their canned claims.
+type fakeVerifier map[string]*userClaims
+
+func (f fakeVerifier) Verify(ctx context.Context, token string) (*userClaims, error) {
+	if u, ok := f[token]; ok {
+		return u, nil
+	}
+	return nil, fmt.Errorf("%w: not a fake token", errInvalidSignature)
+}
+
+func TestAPIMe_FakeVerifier(t *testing.T) {
+	cfg := testCfg
+	cfg.Verifier = fakeVerifier{"fake.alice.token": {UID: "alice", Email: "alice@example.com"}}
+	captureLogs(t)
+
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"fake.alice.token", http.StatusOK},
+		{"fake.mallory.token", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		rec := httptest.NewRecorder()
+		newMux(cfg).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.token, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusOK {
+			var u userClaims
+			json.Unmarshal(rec.Body.Bytes(), &u)
+			if u.UID != "alice" || u.Email != "alice@example.com" {
+				t.Errorf("user = %+v, want the canned claims", u)
+			}
+		}
+	}
+}
+
 func TestAPIMe_ValidToken_JSON(t *testing.T) {
 	srv := newTestServer()
 	defer srv.Close()
@@ -412,8 +1009,8 @@ func TestAPIMe_ValidToken_JSON(t *testing.T) {
 		t.Fatalf("GET /api/me: %v", err)
 	}
 	defer resp.Body.Close()
-	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
-		t.Errorf("Content-Type = %q, want application/json", ct)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want application/json; charset=utf-8", ct)
 	}
 }
 
@@ -445,7 +1042,7 @@ func TestVerify_Valid(t *testing.T) {
 	kid := "v-valid"
 	pk := generateTestKey(t, kid)
 	tok := signToken(t, pk, kid, validClaims())
-	u, err := verifyIDToken(tok, testProjectID)
+	u, err := verifyIDToken(context.Background(), tok, testCfg)
 	if err != nil {
 		t.Fatalf("verifyIDToken: %v", err)
 	}
@@ -466,306 +1063,3133 @@ func TestVerify_Expired(t *testing.T) {
 	c := validClaims()
 	c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-1 * time.Hour))
 	tok := signToken(t, pk, kid, c)
-	_, err := verifyIDToken(tok, testProjectID)
+	_, err := verifyIDToken(context.Background(), tok, testCfg)
 	if err == nil {
 		t.Error("expected error for expired token")
 	}
 }
 
-func TestVerify_WrongIssuer(t *testing.T) {
-	kid := "v-iss"
-	pk := generateTestKey(t, kid)
-	c := validClaims()
-	c.Issuer = "https://securetoken.google.com/wrong-project"
-	tok := signToken(t, pk, kid, c)
-	_, err := verifyIDToken(tok, testProjectID)
-	if err == nil {
-		t.Error("expected error for wrong issuer")
-	}
-	if !strings.Contains(err.Error(), "issuer") {
-		t.Errorf("error should mention issuer: %v", err)
+func TestAPIMe_MissingKid(t *testing.T) {
+	// The signing key is cached, so only the missing kid can fail these.
+	pk := generateTestKey(t, "v-cached")
+	for name, setKid := range map[string]func(h map[string]any){
+		"no kid header": func(h map[string]any) { delete(h, "kid") },
+		"empty kid":     func(h map[string]any) { h["kid"] = "" },
+	} {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+		setKid(token.Header)
+		tok, err := token.SignedString(pk)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		if _, err := verifyIDToken(context.Background(), tok, testCfg); !errors.Is(err, errMissingKid) {
+			t.Errorf("%s: err = %v, want errMissingKid", name, err)
+		}
+
+		req := httptest.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		newMux(testCfg).ServeHTTP(rec, req)
+		var env errorEnvelope
+		json.Unmarshal(rec.Body.Bytes(), &env)
+		if rec.Code != http.StatusUnauthorized || env.Error.Code != codeMissingKid {
+			t.Errorf("%s: got %d %q, want 401 %s", name, rec.Code, env.Error.Code, codeMissingKid)
+		}
 	}
 }
 
-func TestVerify_WrongAudience(t *testing.T) {
-	kid := "v-aud"
+func TestVerify_IssuedInFuture(t *testing.T) {
+	kid := "v-iat-future"
 	pk := generateTestKey(t, kid)
 	c := validClaims()
-	c.Audience = jwt.ClaimStrings{"wrong-project"}
+	c.IssuedAt = jwt.NewNumericDate(time.Now().Add(10 * time.Minute))
 	tok := signToken(t, pk, kid, c)
-	_, err := verifyIDToken(tok, testProjectID)
-	if err == nil {
-		t.Error("expected error for wrong audience")
-	}
-	if !strings.Contains(err.Error(), "audience") {
-		t.Errorf("error should mention audience: %v", err)
+	_, err := verifyIDToken(context.Background(), tok, testCfg)
+	if !errors.Is(err, errIssuedInFuture) {
+		t.Errorf("err = %v, want errIssuedInFuture", err)
 	}
 }
 
-func TestVerify_EmptySubject(t *testing.T) {
-	kid := "v-sub"
+func TestVerify_IssuedWithinSkew(t *testing.T) {
+	kid := "v-iat-skew"
 	pk := generateTestKey(t, kid)
 	c := validClaims()
-	c.Subject = ""
+	c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Minute))
 	tok := signToken(t, pk, kid, c)
-	_, err := verifyIDToken(tok, testProjectID)
-	if err == nil {
-		t.Error("expected error for empty subject")
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); err != nil {
+		t.Fatalf("iat 1m ahead should be tolerated: %v", err)
 	}
-}
 
-func TestVerify_WrongKey(t *testing.T) {
-	kid := "v-wrongkey"
-	generateTestKey(t, kid)
-	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-	tok := signToken(t, otherKey, kid, validClaims())
-	_, err := verifyIDToken(tok, testProjectID)
-	if err == nil {
-		t.Error("expected error for wrong signing key")
+	cfg := testCfg
+	cfg.MaxIssuedAtSkew = 30 * time.Second
+	if _, err := verifyIDToken(context.Background(), tok, cfg); !errors.Is(err, errIssuedInFuture) {
+		t.Errorf("with 30s skew: err = %v, want errIssuedInFuture", err)
 	}
 }
 
-func TestVerify_UnknownKID(t *testing.T) {
-	kid := "v-known"
+func TestVerify_ClockSkewLeeway(t *testing.T) {
+	kid := "v-leeway"
 	pk := generateTestKey(t, kid)
-	tok := signToken(t, pk, "v-unknown", validClaims())
-	_, err := verifyIDToken(tok, testProjectID)
-	if err == nil {
-		t.Error("expected error for unknown kid")
+	early := validClaims()
+	early.NotBefore = jwt.NewNumericDate(time.Now().Add(30 * time.Second))
+	expired := validClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-30 * time.Second))
+
+	lenient := testCfg
+	lenient.ClockSkewLeeway = time.Minute
+	lenientEmulator := emulatorCfg
+	lenientEmulator.ClockSkewLeeway = time.Minute
+
+	for name, claims := range map[string]firebaseClaims{"nbf 30s ahead": early, "expired 30s ago": expired} {
+		tok := signToken(t, pk, kid, claims)
+		if _, err := verifyIDToken(context.Background(), tok, testCfg); err == nil {
+			t.Errorf("%s: verifyIDToken without leeway succeeded, want an error", name)
+		}
+		if _, err := verifyIDToken(context.Background(), tok, lenient); err != nil {
+			t.Errorf("%s: verifyIDToken with 60s leeway: %v", name, err)
+		}
+
+		unsigned := signUnsignedToken(t, claims)
+		if _, err := verifyEmulatorToken(context.Background(), unsigned, emulatorCfg); err == nil {
+			t.Errorf("%s: verifyEmulatorToken without leeway succeeded, want an error", name)
+		}
+		if _, err := verifyEmulatorToken(context.Background(), unsigned, lenientEmulator); err != nil {
+			t.Errorf("%s: verifyEmulatorToken with 60s leeway: %v", name, err)
+		}
 	}
 }
 
-// ── 404 catch-all ───────────────────────────────
+func TestVerifyLenient_ExpiredReturnsClaimsAndWarning(t *testing.T) {
+	kid := "v-lenient"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	tok := signToken(t, pk, kid, c)
 
-func TestCatchAll_404(t *testing.T) {
-	srv := newTestServer()
-	defer srv.Close()
-	resp, err := http.Get(srv.URL + "/nonexistent")
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); !errors.Is(err, errTokenExpired) {
+		t.Fatalf("strict: err = %v, want errTokenExpired", err)
+	}
+	user, warnings, err := verifyLenient(context.Background(), tok, testCfg)
 	if err != nil {
-		t.Fatalf("GET /nonexistent: %v", err)
+		t.Fatalf("verifyLenient: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 404 {
-		t.Errorf("status = %d, want 404", resp.StatusCode)
+	if user.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q", user.UID)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "expired") {
+		t.Errorf("warnings = %q, want one expiry warning", warnings)
+	}
+
+	// A valid token has no warnings.
+	if _, warnings, err := verifyLenient(context.Background(), signToken(t, pk, kid, validClaims()), testCfg); err != nil || len(warnings) != 0 {
+		t.Errorf("valid token: warnings = %q, err = %v", warnings, err)
 	}
 }
 
-func TestCatchAll_EmptyBody(t *testing.T) {
-	srv := newTestServer()
-	defer srv.Close()
-	resp, err := http.Get(srv.URL + "/nonexistent")
-	if err != nil {
-		t.Fatalf("GET /nonexistent: %v", err)
-	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	if len(body) != 0 {
-		t.Errorf("404 body should be empty, got %d bytes", len(body))
+func TestVerifyLenient_SignatureStillFatal(t *testing.T) {
+	generateTestKey(t, "v-lenient-sig")
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	c := validClaims()
+	c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	if user, _, err := verifyLenient(context.Background(), signToken(t, other, "v-lenient-sig", c), testCfg); !errors.Is(err, errInvalidSignature) || user != nil {
+		t.Errorf("verifyLenient = %v, %v; want errInvalidSignature", user, err)
 	}
 }
 
-// ── JSON helpers ────────────────────────────────
+func TestVerify_PhaseTimingsLogged(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := newCertServer(t, "v-phases", pk)
+	prev := keyCache
+	keyCache = &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+	buf := captureLogs(t)
 
-func TestWriteError_Format(t *testing.T) {
-	w := httptest.NewRecorder()
-	writeError(w, 401, "UNAUTHENTICATED", "test msg")
-	if w.Code != 401 {
-		t.Errorf("status = %d", w.Code)
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, "v-phases", validClaims()), testCfg); err != nil {
+		t.Fatalf("verifyIDToken: %v", err)
 	}
-	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
-		t.Errorf("Content-Type = %q", ct)
+
+	var entry map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		if json.Unmarshal([]byte(line), &m) == nil && m["msg"] == "token verification phases" {
+			entry = m
+		}
 	}
-	var env errorEnvelope
-	json.Unmarshal(w.Body.Bytes(), &env)
-	if env.Error.Code != "UNAUTHENTICATED" {
-		t.Errorf("code = %q", env.Error.Code)
+	if entry == nil {
+		t.Fatalf("no phase timing log, got:\n%s", buf.String())
 	}
-	if env.Error.Message != "test msg" {
-		t.Errorf("message = %q", env.Error.Message)
+	for _, field := range []string{"parse_ms", "key_lookup_ms", "signature_ms", "claims_ms"} {
+		if _, ok := entry[field].(float64); !ok {
+			t.Errorf("missing %s in %v", field, entry)
+		}
+	}
+	// The cold cache means the key lookup included a fetch.
+	if ms, _ := entry["key_lookup_ms"].(float64); ms <= 0 {
+		t.Errorf("key_lookup_ms = %v, want > 0 on a cold cache", ms)
+	}
+	if entry["ok"] != true {
+		t.Errorf("ok = %v, want true", entry["ok"])
 	}
 }
 
-func TestWriteJSON_Format(t *testing.T) {
-	w := httptest.NewRecorder()
-	writeJSON(w, 200, map[string]string{"hello": "world"})
-	if w.Code != 200 {
-		t.Errorf("status = %d", w.Code)
+func TestVerify_KidFormat(t *testing.T) {
+	kid := "0123456789abcdef0123456789abcdef01234567"
+	pk := generateTestKey(t, kid)
+	cfg := testCfg
+	cfg.EnforceKidFormat = true
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, kid, validClaims()), cfg); err != nil {
+		t.Fatalf("well-formed kid rejected: %v", err)
 	}
-	var m map[string]string
-	json.Unmarshal(w.Body.Bytes(), &m)
-	if m["hello"] != "world" {
-		t.Errorf("hello = %q", m["hello"])
+
+	_, err := verifyIDToken(context.Background(), signToken(t, pk, "../../etc/passwd", validClaims()), cfg)
+	if !errors.Is(err, errMalformedToken) || !strings.Contains(err.Error(), "not a 40-character Google key ID") {
+		t.Errorf("err = %v, want kid format rejection", err)
 	}
 }
 
-// ── Emulator support ────────────────────────────
+func TestVerify_WrongIssuer(t *testing.T) {
+	kid := "v-iss"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	c.Issuer = "https://securetoken.google.com/wrong-project"
+	tok := signToken(t, pk, kid, c)
+	_, err := verifyIDToken(context.Background(), tok, testCfg)
+	if err == nil {
+		t.Error("expected error for wrong issuer")
+	}
+	if !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("error should mention issuer: %v", err)
+	}
+}
 
-var emulatorCfg = firebaseConfig{
-	ProjectID:        testProjectID,
-	APIKey:           "AIzaSyTestKey",
-	AuthDomain:       "test-project-123.firebaseapp.com",
-	AuthEmulatorHost: "localhost:9099",
+func TestVerify_ValidIssuers(t *testing.T) {
+	kid := "v-issuers"
+	pk := generateTestKey(t, kid)
+	cfg := testCfg
+	cfg.ValidIssuers = []string{
+		"https://securetoken.google.com/" + testProjectID,
+		"https://securetoken.google.com/old-project",
+	}
+
+	// Tokens as each project mints them: aud is the issuing project.
+	for _, project := range []string{testProjectID, "old-project"} {
+		iss := "https://securetoken.google.com/" + project
+		c := validClaims()
+		c.Issuer = iss
+		c.Audience = jwt.ClaimStrings{project}
+		u, err := verifyIDToken(context.Background(), signToken(t, pk, kid, c), cfg)
+		if err != nil {
+			t.Errorf("issuer %q rejected: %v", iss, err)
+			continue
+		}
+		if u.Issuer != iss {
+			t.Errorf("Issuer = %q, want %q", u.Issuer, iss)
+		}
+	}
+
+	// The old project's audience is only accepted from its own issuer.
+	c := validClaims()
+	c.Audience = jwt.ClaimStrings{"old-project"}
+	_, err := verifyIDToken(context.Background(), signToken(t, pk, kid, c), cfg)
+	if !errors.Is(err, errInvalidClaims) || !strings.Contains(err.Error(), "audience") {
+		t.Errorf("old-project aud from the current issuer: err = %v, want audience rejection", err)
+	}
+
+	c = validClaims()
+	c.Issuer = "https://securetoken.google.com/unlisted-project"
+	_, err = verifyIDToken(context.Background(), signToken(t, pk, kid, c), cfg)
+	if !errors.Is(err, errInvalidClaims) || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("unlisted issuer: err = %v, want issuer rejection", err)
+	}
 }
 
-func signUnsignedToken(t *testing.T, claims firebaseClaims) string {
-	t.Helper()
-	token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
-	s, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+func TestVerify_LinkedProviders(t *testing.T) {
+	kid := "v-identities"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	c.Firebase.Identities = map[string]any{
+		"password":   []any{"jane@example.com"},
+		"google.com": []any{"110169484474386276334"},
+	}
+	u, err := verifyIDToken(context.Background(), signToken(t, pk, kid, c), testCfg)
 	if err != nil {
-		t.Fatalf("signing unsigned token: %v", err)
+		t.Fatalf("verifyIDToken: %v", err)
+	}
+	if want := []string{"google.com", "password"}; !slices.Equal(u.LinkedProviders, want) {
+		t.Errorf("LinkedProviders = %v, want %v", u.LinkedProviders, want)
+	}
+
+	body, _ := json.Marshal(u)
+	if !strings.Contains(string(body), `"linked_providers":["google.com","password"]`) {
+		t.Errorf("JSON = %s, want linked_providers", body)
 	}
-	return s
 }
 
-func TestVerifyEmulatorToken_Valid(t *testing.T) {
-	tok := signUnsignedToken(t, validClaims())
-	u, err := verifyEmulatorToken(tok, testProjectID)
+func TestVerify_ExpiresIn(t *testing.T) {
+	kid := "v-expires-in"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(30 * time.Minute))
+	u, err := verifyIDToken(context.Background(), signToken(t, pk, kid, c), testCfg)
 	if err != nil {
-		t.Fatalf("verifyEmulatorToken: %v", err)
+		t.Fatalf("verifyIDToken: %v", err)
 	}
-	if u.UID != "user-uid-abc123" {
-		t.Errorf("uid = %q, want user-uid-abc123", u.UID)
+	if u.ExpiresIn <= 0 || u.ExpiresIn > 1800 || u.ExpiresIn < 1790 {
+		t.Errorf("ExpiresIn = %d, want just under 1800", u.ExpiresIn)
 	}
-	if u.Email != "jane@example.com" {
-		t.Errorf("email = %q", u.Email)
+
+	now := time.Now()
+	if d := remainingValidity(c.ExpiresAt, now); d != c.ExpiresAt.Time.Sub(now) || d <= 0 {
+		t.Errorf("remainingValidity = %v, want %v", d, c.ExpiresAt.Time.Sub(now))
 	}
-	if u.Name != "Jane Doe" {
-		t.Errorf("name = %q", u.Name)
+	if d := remainingValidity(jwt.NewNumericDate(now.Add(-time.Second)), now); d != 0 {
+		t.Errorf("remainingValidity of a past exp = %v, want 0", d)
 	}
 }
 
-func TestVerifyEmulatorToken_EmptySubject(t *testing.T) {
+func TestVerify_WrongAudience(t *testing.T) {
+	kid := "v-aud"
+	pk := generateTestKey(t, kid)
 	c := validClaims()
-	c.Subject = ""
-	tok := signUnsignedToken(t, c)
-	_, err := verifyEmulatorToken(tok, testProjectID)
+	c.Audience = jwt.ClaimStrings{"wrong-project"}
+	tok := signToken(t, pk, kid, c)
+	_, err := verifyIDToken(context.Background(), tok, testCfg)
 	if err == nil {
-		t.Error("expected error for empty subject")
+		t.Error("expected error for wrong audience")
+	}
+	if !strings.Contains(err.Error(), "audience") {
+		t.Errorf("error should mention audience: %v", err)
 	}
 }
 
-func TestVerifyEmulatorToken_AcceptsRS256(t *testing.T) {
-	kid := "emu-rs256"
+func TestVerify_AuthDomainAudience(t *testing.T) {
+	kid := "v-aud-domain"
 	pk := generateTestKey(t, kid)
-	tok := signToken(t, pk, kid, validClaims())
-	u, err := verifyEmulatorToken(tok, testProjectID)
-	if err != nil {
-		t.Fatalf("verifyEmulatorToken should accept RS256 too: %v", err)
+	c := validClaims()
+	c.Audience = jwt.ClaimStrings{testCfg.AuthDomain}
+	tok := signToken(t, pk, kid, c)
+
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); !errors.Is(err, errInvalidClaims) {
+		t.Errorf("toggle off: err = %v, want errInvalidClaims", err)
 	}
-	if u.UID != "user-uid-abc123" {
-		t.Errorf("uid = %q", u.UID)
+	cfg := testCfg
+	cfg.AuthDomainAud = true
+	if _, err := verifyIDToken(context.Background(), tok, cfg); err != nil {
+		t.Errorf("toggle on: aud = auth domain should be accepted: %v", err)
+	}
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, kid, validClaims()), cfg); err != nil {
+		t.Errorf("toggle on: aud = project ID should still be accepted: %v", err)
 	}
 }
 
-func TestEmulatorMux_ValidUnsignedToken_200(t *testing.T) {
-	srv := httptest.NewServer(newMux(emulatorCfg))
-	defer srv.Close()
-	tok := signUnsignedToken(t, validClaims())
-	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
-	req.Header.Set("Authorization", "Bearer "+tok)
-	resp, err := http.DefaultClient.Do(req)
+func TestVerify_StringAudience(t *testing.T) {
+	kid := "v-aud-string"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": c.Issuer,
+		"aud": testProjectID, // a bare string, not ["test-project-123"]
+		"sub": c.Subject,
+		"exp": c.ExpiresAt.Unix(),
+		"iat": c.IssuedAt.Unix(),
+	})
+	token.Header["kid"] = kid
+	tok, err := token.SignedString(pk)
 	if err != nil {
-		t.Fatalf("GET /api/me: %v", err)
+		t.Fatalf("signing token: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		t.Fatalf("status = %d, want 200; body = %s", resp.StatusCode, b)
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(tok, ".")[1])
+	if !strings.Contains(string(payload), `"aud":"`+testProjectID+`"`) {
+		t.Fatalf("payload should carry a string aud: %s", payload)
 	}
-	var u userClaims
-	json.NewDecoder(resp.Body).Decode(&u)
-	if u.UID != "user-uid-abc123" {
-		t.Errorf("uid = %q", u.UID)
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); err != nil {
+		t.Errorf("string-form audience rejected: %v", err)
 	}
 }
 
-func TestEmulatorMux_GarbageToken_401(t *testing.T) {
-	srv := httptest.NewServer(newMux(emulatorCfg))
-	defer srv.Close()
-	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
-	req.Header.Set("Authorization", "Bearer garbage")
-	resp, err := http.DefaultClient.Do(req)
+func TestVerify_AudForm(t *testing.T) {
+	kid := "v-aud-form"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": c.Issuer,
+		"aud": testProjectID,
+		"sub": c.Subject,
+		"exp": c.ExpiresAt.Unix(),
+		"iat": c.IssuedAt.Unix(),
+	})
+	token.Header["kid"] = kid
+	stringAud, err := token.SignedString(pk)
 	if err != nil {
-		t.Fatalf("GET /api/me: %v", err)
+		t.Fatalf("signing token: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 401 {
-		t.Errorf("status = %d, want 401", resp.StatusCode)
+	arrayAud := signToken(t, pk, kid, c)
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(arrayAud, ".")[1])
+	if !strings.Contains(string(payload), `"aud":["`) {
+		t.Fatalf("payload should carry an array aud: %s", payload)
+	}
+
+	for _, tc := range []struct {
+		form, accepted, rejected string
+	}{
+		{audFormArray, arrayAud, stringAud},
+		{audFormString, stringAud, arrayAud},
+	} {
+		cfg := testCfg
+		cfg.AudForm = tc.form
+		if _, err := verifyIDToken(context.Background(), tc.accepted, cfg); err != nil {
+			t.Errorf("%s: matching form rejected: %v", tc.form, err)
+		}
+		if _, err := verifyIDToken(context.Background(), tc.rejected, cfg); !errors.Is(err, errInvalidClaims) {
+			t.Errorf("%s: other form: err = %v, want errInvalidClaims", tc.form, err)
+		}
 	}
 }
 
-func TestEmulatorConnectSnippet_WhenSet(t *testing.T) {
-	snippet := emulatorConnectSnippet(emulatorCfg)
-	if !strings.Contains(snippet, "connectAuthEmulator") {
-		t.Error("snippet missing connectAuthEmulator call")
+func TestVerify_EmptyAudienceArray(t *testing.T) {
+	kid := "v-aud-empty"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   c.Issuer,
+		"aud":   []string{},
+		"sub":   c.Subject,
+		"exp":   c.ExpiresAt.Unix(),
+		"iat":   c.IssuedAt.Unix(),
+		"email": c.Email,
+	})
+	token.Header["kid"] = kid
+	tok, err := token.SignedString(pk)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
 	}
-	if !strings.Contains(snippet, "localhost:9099") {
-		t.Error("snippet missing emulator host")
+	_, err = verifyIDToken(context.Background(), tok, testCfg)
+	if err == nil {
+		t.Fatal("expected error for empty audience")
+	}
+	if !strings.Contains(err.Error(), "audience is empty") {
+		t.Errorf("error should say audience is empty: %v", err)
 	}
 }
 
-func TestEmulatorConnectSnippet_WhenEmpty(t *testing.T) {
-	snippet := emulatorConnectSnippet(testCfg)
-	if snippet != "" {
-		t.Errorf("snippet should be empty for production config, got %q", snippet)
+func TestVerify_MultipleAudiences(t *testing.T) {
+	kid := "v-aud-multi"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	c.Audience = jwt.ClaimStrings{"other-project", testProjectID, testProjectID}
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, kid, c), testCfg); err != nil {
+		t.Errorf("audience list containing the project should be accepted: %v", err)
 	}
 }
 
-func TestEmulatorHomePage_HasConnectEmulator(t *testing.T) {
-	srv := httptest.NewServer(newMux(emulatorCfg))
-	defer srv.Close()
-	resp, err := http.Get(srv.URL + "/")
-	if err != nil {
-		t.Fatalf("GET /: %v", err)
+func TestVerify_EmptySubject(t *testing.T) {
+	kid := "v-sub"
+	pk := generateTestKey(t, kid)
+	c := validClaims()
+	c.Subject = ""
+	tok := signToken(t, pk, kid, c)
+	_, err := verifyIDToken(context.Background(), tok, testCfg)
+	if err == nil {
+		t.Error("expected error for empty subject")
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	if !strings.Contains(string(body), "connectAuthEmulator") {
-		t.Error("emulator home page missing connectAuthEmulator call")
+}
+
+func TestVerify_WrongKey(t *testing.T) {
+	kid := "v-wrongkey"
+	generateTestKey(t, kid)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tok := signToken(t, otherKey, kid, validClaims())
+	_, err := verifyIDToken(context.Background(), tok, testCfg)
+	if err == nil {
+		t.Error("expected error for wrong signing key")
 	}
 }
 
-func TestProductionHomePage_NoConnectEmulator(t *testing.T) {
-	srv := newTestServer()
-	defer srv.Close()
-	resp, err := http.Get(srv.URL + "/")
+func TestVerify_UnknownKID(t *testing.T) {
+	kid := "v-known"
+	pk := generateTestKey(t, kid)
+	tok := signToken(t, pk, "v-unknown", validClaims())
+	_, err := verifyIDToken(context.Background(), tok, testCfg)
+	if err == nil {
+		t.Error("expected error for unknown kid")
+	}
+}
+
+func TestVerify_WrongTyp_Enforced(t *testing.T) {
+	kid := "v-typ"
+	pk := generateTestKey(t, kid)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+	token.Header["kid"] = kid
+	token.Header["typ"] = "at+jwt"
+	tok, err := token.SignedString(pk)
 	if err != nil {
-		t.Fatalf("GET /: %v", err)
+		t.Fatalf("signing token: %v", err)
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	s := string(body)
-	// The import will still be there, but the actual connectAuthEmulator() call should not
-	// Check that no connectAuthEmulator(auth, "http://...) call is present
-	if strings.Contains(s, `connectAuthEmulator(auth`) {
-		t.Error("production home page should not call connectAuthEmulator")
+
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); err != nil {
+		t.Errorf("typ should not be checked by default: %v", err)
+	}
+
+	cfg := testCfg
+	cfg.EnforceTokenTyp = true
+	_, err = verifyIDToken(context.Background(), tok, cfg)
+	if err == nil {
+		t.Fatal("expected error for mismatched typ")
+	}
+	if !strings.Contains(err.Error(), "token type") {
+		t.Errorf("error should mention token type: %v", err)
 	}
 }
 
-// ── HTTP method enforcement ─────────────────────
+func TestVerify_JWTTyp_Enforced(t *testing.T) {
+	kid := "v-typ-ok"
+	pk := generateTestKey(t, kid)
+	tok := signToken(t, pk, kid, validClaims())
+	cfg := testCfg
+	cfg.EnforceTokenTyp = true
+	if _, err := verifyIDToken(context.Background(), tok, cfg); err != nil {
+		t.Errorf("typ JWT should be accepted: %v", err)
+	}
+}
 
-func TestHome_POST_Rejected(t *testing.T) {
-	srv := newTestServer()
-	defer srv.Close()
-	resp, err := http.Post(srv.URL+"/", "text/plain", nil)
-	if err != nil {
-		t.Fatalf("POST /: %v", err)
+// domainClaimsValidator applies the default checks and additionally
+// requires an email in a given domain.
+type domainClaimsValidator struct {
+	projectClaimsValidator
+	domain string
+}
+
+func (v domainClaimsValidator) Validate(claims *firebaseClaims) error {
+	if err := v.projectClaimsValidator.Validate(claims); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 405 && resp.StatusCode != 404 {
-		t.Errorf("status = %d, want 404 or 405", resp.StatusCode)
+	if !strings.HasSuffix(claims.Email, "@"+v.domain) {
+		return fmt.Errorf("email %q is not in domain %q", claims.Email, v.domain)
 	}
+	return nil
 }
 
-func TestAPIMe_POST_Rejected(t *testing.T) {
-	srv := newTestServer()
-	defer srv.Close()
-	resp, err := http.Post(srv.URL+"/api/me", "application/json", nil)
-	if err != nil {
-		t.Fatalf("POST /api/me: %v", err)
+func TestVerify_CustomClaimsValidator(t *testing.T) {
+	kid := "v-validator"
+	pk := generateTestKey(t, kid)
+	cfg := testCfg
+	cfg.ClaimsValidator = domainClaimsValidator{projectClaimsValidator{ProjectID: testProjectID}, "example.com"}
+
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, kid, validClaims()), cfg); err != nil {
+		t.Errorf("token in allowed domain rejected: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 405 && resp.StatusCode != 404 {
-		t.Errorf("status = %d, want 404 or 405", resp.StatusCode)
+
+	c := validClaims()
+	c.Email = "mallory@elsewhere.org"
+	_, err := verifyIDToken(context.Background(), signToken(t, pk, kid, c), cfg)
+	if err == nil || !strings.Contains(err.Error(), "domain") {
+		t.Errorf("err = %v, want domain rejection", err)
+	}
+
+	c = validClaims()
+	c.Issuer = "https://securetoken.google.com/wrong-project"
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, kid, c), cfg); err == nil {
+		t.Error("custom validator should still apply the default issuer check")
+	}
+}
+
+// ── Verification error classification ───────────
+
+func TestVerify_SentinelErrors(t *testing.T) {
+	kid := "v-sentinel"
+	pk := generateTestKey(t, kid)
+	expired := validClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-1 * time.Hour))
+	wrongIss := validClaims()
+	wrongIss.Issuer = "https://securetoken.google.com/wrong-project"
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+	hsTok, _ := hs.SignedString([]byte("secret"))
+
+	for _, tc := range []struct {
+		name string
+		tok  string
+		want error
+	}{
+		{"garbage", "garbage", errMalformedToken},
+		{"expired", signToken(t, pk, kid, expired), errTokenExpired},
+		{"wrong issuer", signToken(t, pk, kid, wrongIss), errInvalidClaims},
+		{"wrong key", signToken(t, otherKey, kid, validClaims()), errInvalidSignature},
+		{"unknown kid", signToken(t, pk, "v-unknown", validClaims()), errUnknownKey},
+		{"HS256", hsTok, errUnsupportedAlg},
+	} {
+		_, err := verifyIDToken(context.Background(), tc.tok, testCfg)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want errors.Is %v", tc.name, err, tc.want)
+		}
+		if got := errorCategory(err); got != tc.want.Error() {
+			t.Errorf("%s: category = %q, want %q", tc.name, got, tc.want.Error())
+		}
+	}
+}
+
+func TestGetKey_FetchFailure(t *testing.T) {
+	c := &publicKeyCache{url: "http://127.0.0.1:0", parse: parseX509Certs, store: &memoryKeyStore{}}
+	if _, err := c.getKey(context.Background(), "any"); !errors.Is(err, errKeyFetchFailed) {
+		t.Errorf("err = %v, want errors.Is errKeyFetchFailed", err)
+	}
+}
+
+func TestAPIMe_KeyFetchFailure_503(t *testing.T) {
+	prev := keyCache
+	keyCache = &publicKeyCache{url: "http://127.0.0.1:0", parse: parseX509Certs, store: &memoryKeyStore{}}
+	defer func() { keyCache = prev }()
+
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer "+signToken(t, pk, "k", validClaims()))
+	newMux(testCfg).ServeHTTP(w, r)
+	if w.Code != 503 {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	var env errorEnvelope
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if env.Error.Code != "UNAVAILABLE" {
+		t.Errorf("code = %q, want UNAVAILABLE", env.Error.Code)
+	}
+}
+
+func TestVerify_PS256(t *testing.T) {
+	kid := "v-ps256"
+	pk := generateTestKey(t, kid)
+	token := jwt.NewWithClaims(jwt.SigningMethodPS256, validClaims())
+	token.Header["kid"] = kid
+	tok, err := token.SignedString(pk)
+	if err != nil {
+		t.Fatalf("signing PS256 token: %v", err)
+	}
+
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); !errors.Is(err, errUnsupportedAlg) {
+		t.Errorf("PS256 not allowed: err = %v, want errUnsupportedAlg", err)
+	}
+	cfg := testCfg
+	cfg.AllowPS256 = true
+	user, err := verifyIDToken(context.Background(), tok, cfg)
+	if err != nil {
+		t.Fatalf("PS256 allowed: %v", err)
+	}
+	if user.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q, want user-uid-abc123", user.UID)
+	}
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, kid, validClaims()), cfg); err != nil {
+		t.Errorf("RS256 with PS256 allowed: %v", err)
+	}
+}
+
+// ── Algorithm denylist ──────────────────────────
+
+func signHS256(t *testing.T, claims firebaseClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "hs-kid"
+	s, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("signing HS256 token: %v", err)
+	}
+	return s
+}
+
+func TestDenylist_HS256RejectedEverywhere(t *testing.T) {
+	tok := signHS256(t, validClaims())
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); !errors.Is(err, errUnsupportedAlg) {
+		t.Errorf("verifyIDToken: err = %v, want errUnsupportedAlg", err)
+	}
+	if _, err := verifyEmulatorToken(context.Background(), tok, emulatorCfg); !errors.Is(err, errUnsupportedAlg) {
+		t.Errorf("verifyEmulatorToken: err = %v, want errUnsupportedAlg", err)
+	}
+}
+
+func TestDenylist_WinsOverAllowlist(t *testing.T) {
+	got := allowedAlgs("RS256", "HS256", "none")
+	if strings.Join(got, ",") != "RS256,none" {
+		t.Errorf("allowedAlgs = %v, want [RS256 none]", got)
+	}
+}
+
+func TestDenylist_NoneOnlyInEmulatorMode(t *testing.T) {
+	tok := signUnsignedToken(t, validClaims())
+	if _, err := verifyEmulatorToken(context.Background(), tok, emulatorCfg); err != nil {
+		t.Errorf("emulator should accept alg none: %v", err)
+	}
+	if _, err := verifyIDToken(context.Background(), tok, testCfg); err == nil {
+		t.Error("production verifier must reject alg none")
+	}
+}
+
+// ── Google access tokens ────────────────────────
+
+// newMockTokenInfo points googleTokenInfoURL at a mock that knows a
+// single valid access token.
+func newMockTokenInfo(t *testing.T, validToken string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.FormValue("access_token") != validToken {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_token"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"sub":        "google-sub-42",
+			"email":      "jane@example.com",
+			"scope":      "openid email",
+			"expires_in": "3599",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	prev := googleTokenInfoURL
+	googleTokenInfoURL = srv.URL
+	t.Cleanup(func() { googleTokenInfoURL = prev })
+}
+
+// newMockGoogleCerts points googleIDKeyCache at a mock of Google's v3
+// OAuth2 certs JWKS serving pub under kid.
+func newMockGoogleCerts(t *testing.T, kid string, pub *rsa.PublicKey) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(srv.Close)
+	prev := googleIDKeyCache
+	googleIDKeyCache = &publicKeyCache{url: srv.URL, parse: parseJWKS, store: &memoryKeyStore{}}
+	t.Cleanup(func() { googleIDKeyCache = prev })
+}
+
+// googleIDClaims returns claims of a One Tap ID token for clientID.
+func googleIDClaims(clientID string) firebaseClaims {
+	c := validClaims()
+	c.Issuer = "https://accounts.google.com"
+	c.Audience = jwt.ClaimStrings{clientID}
+	c.Subject = "google-sub-1234"
+	return c
+}
+
+func TestVerifyGoogleIDToken(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newMockGoogleCerts(t, "google-kid", &pk.PublicKey)
+	cfg := testCfg
+	cfg.GoogleClientID = "1234.apps.googleusercontent.com"
+
+	tok := signToken(t, pk, "google-kid", googleIDClaims(cfg.GoogleClientID))
+	u, err := verifyToken(context.Background(), tok, cfg)
+	if err != nil {
+		t.Fatalf("verifyToken: %v", err)
+	}
+	if u.UID != "google-sub-1234" || u.Issuer != "https://accounts.google.com" || u.Email != "jane@example.com" {
+		t.Errorf("user = %+v", u)
+	}
+
+	// Without GOOGLE_CLIENT_ID, the token is only tried as a Firebase token.
+	if _, err := verifyToken(context.Background(), tok, testCfg); err == nil {
+		t.Error("Google ID token accepted without GOOGLE_CLIENT_ID")
+	}
+}
+
+func TestVerifyGoogleIDToken_Rejected(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newMockGoogleCerts(t, "google-kid", &pk.PublicKey)
+	cfg := testCfg
+	cfg.GoogleClientID = "1234.apps.googleusercontent.com"
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	expired := googleIDClaims(cfg.GoogleClientID)
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+
+	for name, tc := range map[string]struct {
+		tok  string
+		want error
+	}{
+		"other client":  {signToken(t, pk, "google-kid", googleIDClaims("5678.apps.googleusercontent.com")), errInvalidClaims},
+		"expired":       {signToken(t, pk, "google-kid", expired), errTokenExpired},
+		"bad signature": {signToken(t, other, "google-kid", googleIDClaims(cfg.GoogleClientID)), errInvalidSignature},
+		"unknown key":   {signToken(t, pk, "rotated-out", googleIDClaims(cfg.GoogleClientID)), errUnknownKey},
+	} {
+		if _, err := verifyGoogleIDToken(context.Background(), tc.tok, cfg); !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", name, err, tc.want)
+		}
+	}
+}
+
+func TestVerifyGoogleIDToken_TypAndAudForm(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newMockGoogleCerts(t, "google-kid", &pk.PublicKey)
+	cfg := testCfg
+	cfg.GoogleClientID = "1234.apps.googleusercontent.com"
+	cfg.EnforceTokenTyp = true
+	cfg.AudForm = audFormString
+
+	sign := func(typ string, aud any) string {
+		c := googleIDClaims(cfg.GoogleClientID)
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": c.Issuer,
+			"aud": aud,
+			"sub": c.Subject,
+			"exp": c.ExpiresAt.Unix(),
+			"iat": c.IssuedAt.Unix(),
+		})
+		token.Header["kid"] = "google-kid"
+		token.Header["typ"] = typ
+		tok, err := token.SignedString(pk)
+		if err != nil {
+			t.Fatalf("signing token: %v", err)
+		}
+		return tok
+	}
+
+	if _, err := verifyGoogleIDToken(context.Background(), sign("JWT", cfg.GoogleClientID), cfg); err != nil {
+		t.Errorf("conforming token rejected: %v", err)
+	}
+	if _, err := verifyGoogleIDToken(context.Background(), sign("at+jwt", cfg.GoogleClientID), cfg); !errors.Is(err, errMalformedToken) {
+		t.Errorf("wrong typ: err = %v, want errMalformedToken", err)
+	}
+	if _, err := verifyGoogleIDToken(context.Background(), sign("JWT", []string{cfg.GoogleClientID}), cfg); !errors.Is(err, errInvalidClaims) {
+		t.Errorf("array aud: err = %v, want errInvalidClaims", err)
+	}
+}
+
+func TestVerifyGoogleAccessToken_Valid(t *testing.T) {
+	newMockTokenInfo(t, "ya29.valid")
+	u, err := verifyGoogleAccessToken(context.Background(), "ya29.valid")
+	if err != nil {
+		t.Fatalf("verifyGoogleAccessToken: %v", err)
+	}
+	if u.UID != "google-sub-42" {
+		t.Errorf("uid = %q, want google-sub-42", u.UID)
+	}
+	if u.Email != "jane@example.com" {
+		t.Errorf("email = %q", u.Email)
+	}
+}
+
+func TestVerifyGoogleAccessToken_Invalid(t *testing.T) {
+	newMockTokenInfo(t, "ya29.valid")
+	_, err := verifyGoogleAccessToken(context.Background(), "ya29.revoked")
+	if !errors.Is(err, errInvalidClaims) {
+		t.Errorf("err = %v, want errInvalidClaims", err)
+	}
+}
+
+func TestVerifyGoogleAccessToken_Unreachable(t *testing.T) {
+	prev := googleTokenInfoURL
+	googleTokenInfoURL = "http://127.0.0.1:0"
+	defer func() { googleTokenInfoURL = prev }()
+	_, err := verifyGoogleAccessToken(context.Background(), "ya29.any")
+	if !errors.Is(err, errTokenInfoFailed) {
+		t.Errorf("err = %v, want errTokenInfoFailed", err)
+	}
+}
+
+// ── 404 catch-all ───────────────────────────────
+
+func TestCatchAll_404(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/nonexistent")
+	if err != nil {
+		t.Fatalf("GET /nonexistent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestCatchAll_EmptyBody(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/nonexistent")
+	if err != nil {
+		t.Fatalf("GET /nonexistent: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if len(body) != 0 {
+		t.Errorf("404 body should be empty, got %d bytes", len(body))
+	}
+}
+
+func TestCatchAll_BrowserGetsHTML(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/nonexistent", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /nonexistent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html; charset=utf-8", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `href="/"`) {
+		t.Error("404 page missing link to home")
+	}
+}
+
+func TestCatchAll_APIPathStaysEmpty(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/api/nonexistent", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/nonexistent: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 404 || len(body) != 0 {
+		t.Errorf("got %d with %d bytes, want empty 404", resp.StatusCode, len(body))
+	}
+}
+
+// ── API-only mode ───────────────────────────────
+
+func TestAPIOnly_NoHTMLRoutes(t *testing.T) {
+	cfg := testCfg
+	cfg.APIOnly = true
+	mux := newMux(cfg)
+	for _, path := range []string{"/", "/profile", "/static/app.js"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", "text/html")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 404", path, rec.Code)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("GET %s: body = %q, want empty", path, rec.Body.String())
+		}
+	}
+}
+
+func TestAPIOnly_APIMeStillServed(t *testing.T) {
+	cfg := testCfg
+	cfg.APIOnly = true
+	kid := "key-api-only"
+	privKey := generateTestKey(t, kid)
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, privKey, kid, validClaims()))
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200; body = %s", rec.Code, rec.Body.String())
+	}
+}
+
+// ── Development bypass token ────────────────────
+
+func TestDevBypassToken_FakeUser(t *testing.T) {
+	cfg := testCfg
+	cfg.DevBypassToken = "let-me-in"
+	cfg.DevBypassUID = "e2e-user"
+	cfg.DevBypassEmail = "e2e@example.com"
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer let-me-in")
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body = %s", rec.Code, rec.Body.String())
+	}
+	var u userClaims
+	json.Unmarshal(rec.Body.Bytes(), &u)
+	if u.UID != "e2e-user" || u.Email != "e2e@example.com" {
+		t.Errorf("user = %+v, want the configured fake user", u)
+	}
+
+	// Without the config the same string is just a malformed token.
+	rec = httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without DEV_BYPASS_TOKEN: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestDevBypassToken_RefusedInProduction(t *testing.T) {
+	for _, env := range []string{"production", "PRODUCTION"} {
+		if err := checkDevBypassAllowed(env); err == nil {
+			t.Errorf("ENV=%s: bypass allowed, want refusal", env)
+		}
+	}
+	for _, env := range []string{"", "development", "test"} {
+		if err := checkDevBypassAllowed(env); err != nil {
+			t.Errorf("ENV=%q: %v", env, err)
+		}
+	}
+}
+
+// ── Misconfigured mode ──────────────────────────
+
+func TestMisconfigured_API503(t *testing.T) {
+	cfg := firebaseConfig{MissingVars: []string{"FIREBASE_PROJECT_ID", "FIREBASE_API_KEY"}}
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/api/me", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	var env errorEnvelope
+	json.Unmarshal(rec.Body.Bytes(), &env)
+	if env.Error.Code != "UNAVAILABLE" || !strings.Contains(env.Error.Message, "FIREBASE_PROJECT_ID, FIREBASE_API_KEY") {
+		t.Errorf("error = %+v, want UNAVAILABLE naming the missing vars", env.Error)
+	}
+	if code, status := healthStatus(t, cfg); code != 503 || status != "NOT_SERVING" {
+		t.Errorf("health = %d %s, want 503 NOT_SERVING", code, status)
+	}
+}
+
+func TestMisconfigured_Banner(t *testing.T) {
+	cfg := firebaseConfig{MissingVars: []string{"FIREBASE_AUTH_DOMAIN"}}
+	for _, page := range []string{homePage(cfg), profilePage(cfg)} {
+		if !strings.Contains(page, `class="config-banner"`) || !strings.Contains(page, "FIREBASE_AUTH_DOMAIN") {
+			t.Error("page missing the configuration-needed banner")
+		}
+	}
+	if strings.Contains(homePage(testCfg), `class="config-banner"`) {
+		t.Error("banner shown without missing configuration")
+	}
+}
+
+// ── Base path ───────────────────────────────────
+
+func TestBasePath_RoutesPrefixed(t *testing.T) {
+	cfg := testCfg
+	cfg.BasePath = "/auth"
+	mux := newMux(cfg)
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/auth", 200},
+		{"/auth/profile", 200},
+		{"/auth" + appCSSAsset.path, 200},
+		{"/auth/api/me", 401},
+		{"/", 404},
+		{"/profile", 404},
+		{"/api/me", 404},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s: status = %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestBasePath_OutsidePrefixCountedAsNotFound(t *testing.T) {
+	buf := captureLogs(t)
+	cfg := testCfg
+	cfg.BasePath = "/auth"
+	before := notFoundTotal.Load()
+
+	rec := httptest.NewRecorder()
+	newHandler(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/wp-login.php", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", rec.Code)
+	}
+	if n := notFoundTotal.Load() - before; n != 1 {
+		t.Errorf("notfound_total grew by %d, want 1", n)
+	}
+	if entries := requestLogs(t, buf); len(entries) != 1 || entries[0]["level"] != "DEBUG" {
+		t.Errorf("request logs = %v, want one DEBUG entry", entries)
+	}
+}
+
+func TestBasePath_TemplateLinksPrefixed(t *testing.T) {
+	cfg := testCfg
+	cfg.BasePath = "/auth"
+	home, profile := homePage(cfg), profilePage(cfg)
+	for _, want := range []string{
+		`href="/auth/profile"`,
+		`href="/auth` + appCSSAsset.url() + `"`,
+		`from "/auth` + appJSAsset.url() + `"`,
+	} {
+		if !strings.Contains(home, want) {
+			t.Errorf("home page missing %s", want)
+		}
+	}
+	for _, want := range []string{`href="/auth" class="btn btn-home"`, `fetch("/auth/api/me"`} {
+		if !strings.Contains(profile, want) {
+			t.Errorf("profile page missing %s", want)
+		}
+	}
+	if strings.Contains(profile, `fetch("/api/me"`) {
+		t.Error("profile page still fetches the unprefixed /api/me")
+	}
+}
+
+// ── JSON helpers ────────────────────────────────
+
+func TestWriteError_Format(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("GET", "/api/me", nil), 401, "UNAUTHENTICATED", "test msg", testCfg)
+	if w.Code != 401 {
+		t.Errorf("status = %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var env errorEnvelope
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if env.Error.Code != "UNAUTHENTICATED" {
+		t.Errorf("code = %q", env.Error.Code)
+	}
+	if env.Error.Message != "test msg" {
+		t.Errorf("message = %q", env.Error.Message)
+	}
+}
+
+func TestWriteError_JSONOptions(t *testing.T) {
+	cfg := testCfg
+	cfg.JSONNoEscapeHTML = true
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("GET", "/api/me?pretty=1", nil), 404, codeNotFound, "No API endpoint at /api/<x>", cfg)
+	body := w.Body.String()
+	if !strings.Contains(body, "\n  \"error\": {") {
+		t.Errorf("?pretty=1 not applied to the error body:\n%s", body)
+	}
+	if !strings.Contains(body, "/api/<x>") {
+		t.Errorf("JSON_ESCAPE_HTML=false not applied to the error body:\n%s", body)
+	}
+}
+
+func TestWriteJSON_Format(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSON(w, 200, map[string]string{"hello": "world"})
+	if w.Code != 200 {
+		t.Errorf("status = %d", w.Code)
+	}
+	var m map[string]string
+	json.Unmarshal(w.Body.Bytes(), &m)
+	if m["hello"] != "world" {
+		t.Errorf("hello = %q", m["hello"])
+	}
+}
+
+func TestWriteJSON_CharsetAndNosniff(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSON(w, 200, map[string]string{"hello": "wörld"})
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want application/json; charset=utf-8", ct)
+	}
+	if v := w.Header().Get("X-Content-Type-Options"); v != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", v)
+	}
+}
+
+func TestWriteJSONOpts_EscapeHTML(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSON(w, 200, map[string]string{"v": "<b>&</b>"})
+	if !strings.Contains(w.Body.String(), `\u003cb\u003e\u0026`) {
+		t.Errorf("default output should escape HTML, got %s", w.Body.String())
+	}
+}
+
+func TestWriteJSONOpts_NoEscapeHTML(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSONOpts(w, 200, map[string]string{"v": "<b>&</b>"}, jsonOptions{EscapeHTML: false})
+	if !strings.Contains(w.Body.String(), `"<b>&</b>"`) {
+		t.Errorf("output should not escape HTML, got %s", w.Body.String())
+	}
+}
+
+func TestAPIMe_Pretty(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	kid := "key-pretty"
+	privKey := generateTestKey(t, kid)
+	tok := signToken(t, privKey, kid, validClaims())
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me?pretty=1", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "{\n  \"uid\": \"user-uid-abc123\"") {
+		t.Errorf("body should be pretty-printed, got %s", body)
+	}
+}
+
+func TestErrorCodes_MappingApplied(t *testing.T) {
+	cfg := testCfg
+	cfg.ErrorCodes = map[string]string{codeUnauthenticated: "AUTH_REQUIRED"}
+	mux := newMux(cfg)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/me", nil))
+	var env errorEnvelope
+	if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if env.Error.Code != "AUTH_REQUIRED" {
+		t.Errorf("/api/me code = %q, want AUTH_REQUIRED", env.Error.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/verify/batch", strings.NewReader(`{"tokens":["garbage"]}`)))
+	var batch batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &batch); err != nil {
+		t.Fatalf("decode batch: %v", err)
+	}
+	if len(batch.Results) != 1 || batch.Results[0].Error == nil || batch.Results[0].Error.Code != "AUTH_REQUIRED" {
+		t.Errorf("batch results = %+v, want AUTH_REQUIRED error", batch.Results)
+	}
+
+	// Unmapped codes pass through unchanged.
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/verify/batch", strings.NewReader(`{`)))
+	if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if env.Error.Code != codeInvalidArgument {
+		t.Errorf("code = %q, want %s", env.Error.Code, codeInvalidArgument)
+	}
+}
+
+type decodeTarget struct {
+	Name string `json:"name"`
+}
+
+func decodeRecorder(body string) (*httptest.ResponseRecorder, bool) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	var dst decodeTarget
+	return w, decodeJSON(w, r, &dst, testCfg)
+}
+
+func TestDecodeJSON_Valid(t *testing.T) {
+	_, ok := decodeRecorder(`{"name":"x"}`)
+	if !ok {
+		t.Error("valid body should decode")
+	}
+}
+
+func TestDecodeJSON_Oversized_413(t *testing.T) {
+	w, ok := decodeRecorder(`{"name":"` + strings.Repeat("a", maxJSONBodyBytes) + `"}`)
+	if ok {
+		t.Fatal("oversized body should be rejected")
+	}
+	if w.Code != 413 {
+		t.Errorf("status = %d, want 413", w.Code)
+	}
+}
+
+func TestDecodeJSON_Malformed_400(t *testing.T) {
+	w, ok := decodeRecorder(`{"name":`)
+	if ok {
+		t.Fatal("malformed body should be rejected")
+	}
+	if w.Code != 400 {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	var env errorEnvelope
+	json.Unmarshal(w.Body.Bytes(), &env)
+	if env.Error.Code != "INVALID_ARGUMENT" {
+		t.Errorf("code = %q, want INVALID_ARGUMENT", env.Error.Code)
+	}
+}
+
+func TestDecodeJSON_UnknownField_400(t *testing.T) {
+	w, ok := decodeRecorder(`{"name":"x","extra":1}`)
+	if ok {
+		t.Fatal("unknown field should be rejected")
+	}
+	if w.Code != 400 {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestDecodeJSON_TrailingData_400(t *testing.T) {
+	w, ok := decodeRecorder(`{"name":"x"}{"name":"y"}`)
+	if ok {
+		t.Fatal("trailing data should be rejected")
+	}
+	if w.Code != 400 {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+// ── Emulator support ────────────────────────────
+
+var emulatorCfg = firebaseConfig{
+	ProjectID:        testProjectID,
+	APIKey:           "AIzaSyTestKey",
+	AuthDomain:       "test-project-123.firebaseapp.com",
+	AuthEmulatorHost: "localhost:9099",
+}
+
+func signUnsignedToken(t *testing.T, claims firebaseClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	s, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("signing unsigned token: %v", err)
+	}
+	return s
+}
+
+func TestProbeEmulator(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"authEmulator": "ready"})
+	}))
+	defer up.Close()
+	if err := probeEmulator(up.Listener.Addr().String(), time.Second); err != nil {
+		t.Errorf("probe of a running emulator: %v", err)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	host := down.Listener.Addr().String()
+	down.Close()
+	if err := probeEmulator(host, time.Second); err == nil {
+		t.Error("probe of a stopped emulator succeeded, want an error")
+	}
+}
+
+func TestVerifyEmulatorToken_Valid(t *testing.T) {
+	tok := signUnsignedToken(t, validClaims())
+	u, err := verifyEmulatorToken(context.Background(), tok, emulatorCfg)
+	if err != nil {
+		t.Fatalf("verifyEmulatorToken: %v", err)
+	}
+	if u.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q, want user-uid-abc123", u.UID)
+	}
+	if u.Email != "jane@example.com" {
+		t.Errorf("email = %q", u.Email)
+	}
+	if u.Name != "Jane Doe" {
+		t.Errorf("name = %q", u.Name)
+	}
+}
+
+func TestVerifyEmulatorToken_EmptySubject(t *testing.T) {
+	c := validClaims()
+	c.Subject = ""
+	tok := signUnsignedToken(t, c)
+	_, err := verifyEmulatorToken(context.Background(), tok, emulatorCfg)
+	if err == nil {
+		t.Error("expected error for empty subject")
+	}
+}
+
+func TestVerifyEmulatorToken_AcceptsRS256(t *testing.T) {
+	kid := "emu-rs256"
+	pk := generateTestKey(t, kid)
+	tok := signToken(t, pk, kid, validClaims())
+	u, err := verifyEmulatorToken(context.Background(), tok, emulatorCfg)
+	if err != nil {
+		t.Fatalf("verifyEmulatorToken should accept RS256 too: %v", err)
+	}
+	if u.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q", u.UID)
+	}
+}
+
+func TestVerifyEmulatorToken_Strict(t *testing.T) {
+	kid := "emu-strict"
+	pk := generateTestKey(t, kid)
+	rs256 := signToken(t, pk, kid, validClaims())
+	cfg := emulatorCfg
+	cfg.EmulatorStrict = true
+
+	if _, err := verifyEmulatorToken(context.Background(), rs256, cfg); !errors.Is(err, errUnsupportedAlg) {
+		t.Errorf("strict: err = %v, want errUnsupportedAlg", err)
+	}
+	if _, err := verifyEmulatorToken(context.Background(), rs256, emulatorCfg); err != nil {
+		t.Errorf("lenient: RS256 token rejected: %v", err)
+	}
+	if _, err := verifyEmulatorToken(context.Background(), signUnsignedToken(t, validClaims()), cfg); err != nil {
+		t.Errorf("strict: unsigned token rejected: %v", err)
+	}
+}
+
+// newMockEmulator serves a JWKS containing pub at the emulator's JWKS
+// path and returns a config pointing at it with JWKS verification on.
+func newMockEmulator(t *testing.T, kid string, pub *rsa.PublicKey) firebaseConfig {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != emulatorJWKSPath || pub == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []jwk{{
+			Kty: "RSA",
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(srv.Close)
+	cfg := emulatorCfg
+	cfg.AuthEmulatorHost = srv.Listener.Addr().String()
+	cfg.AuthEmulatorJWKS = true
+	return cfg
+}
+
+func TestVerifyEmulatorToken_JWKS_SignedToken(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cfg := newMockEmulator(t, "emu-kid", &pk.PublicKey)
+	tok := signToken(t, pk, "emu-kid", validClaims())
+	u, err := verifyEmulatorToken(context.Background(), tok, cfg)
+	if err != nil {
+		t.Fatalf("verifyEmulatorToken: %v", err)
+	}
+	if u.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q", u.UID)
+	}
+}
+
+func TestVerifyEmulatorToken_JWKS_WrongKey(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cfg := newMockEmulator(t, "emu-kid", &pk.PublicKey)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tok := signToken(t, otherKey, "emu-kid", validClaims())
+	if _, err := verifyEmulatorToken(context.Background(), tok, cfg); err == nil {
+		t.Error("expected error for token signed with a key not in the emulator JWKS")
+	}
+}
+
+func TestVerifyEmulatorToken_JWKS_UnsignedStillAccepted(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cfg := newMockEmulator(t, "emu-kid", &pk.PublicKey)
+	tok := signUnsignedToken(t, validClaims())
+	if _, err := verifyEmulatorToken(context.Background(), tok, cfg); err != nil {
+		t.Fatalf("unsigned emulator token should still be accepted: %v", err)
+	}
+}
+
+func TestVerifyEmulatorToken_JWKS_UnavailableFallsBack(t *testing.T) {
+	cfg := newMockEmulator(t, "emu-kid", nil)
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tok := signToken(t, pk, "emu-kid", validClaims())
+	u, err := verifyEmulatorToken(context.Background(), tok, cfg)
+	if err != nil {
+		t.Fatalf("should fall back to unsigned path without JWKS: %v", err)
+	}
+	if u.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q", u.UID)
+	}
+}
+
+func TestEmulatorMux_ValidUnsignedToken_200(t *testing.T) {
+	srv := httptest.NewServer(newMux(emulatorCfg))
+	defer srv.Close()
+	tok := signUnsignedToken(t, validClaims())
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d, want 200; body = %s", resp.StatusCode, b)
+	}
+	var u userClaims
+	json.NewDecoder(resp.Body).Decode(&u)
+	if u.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q", u.UID)
+	}
+}
+
+func TestEmulatorMux_GarbageToken_401(t *testing.T) {
+	srv := httptest.NewServer(newMux(emulatorCfg))
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me", nil)
+	req.Header.Set("Authorization", "Bearer garbage")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestEmulatorConnectSnippet_WhenSet(t *testing.T) {
+	snippet := emulatorConnectSnippet(emulatorCfg)
+	if !strings.Contains(snippet, "connectAuthEmulator") {
+		t.Error("snippet missing connectAuthEmulator call")
+	}
+	if !strings.Contains(snippet, "localhost:9099") {
+		t.Error("snippet missing emulator host")
+	}
+}
+
+func TestEmulatorConnectSnippet_WhenEmpty(t *testing.T) {
+	snippet := emulatorConnectSnippet(testCfg)
+	if snippet != "" {
+		t.Errorf("snippet should be empty for production config, got %q", snippet)
+	}
+}
+
+func TestEmulatorHomePage_HasConnectEmulator(t *testing.T) {
+	srv := httptest.NewServer(newMux(emulatorCfg))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("GET /: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "connectAuthEmulator") {
+		t.Error("emulator home page missing connectAuthEmulator call")
+	}
+}
+
+func TestProductionHomePage_NoConnectEmulator(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("GET /: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	s := string(body)
+	// The import will still be there, but the actual connectAuthEmulator() call should not
+	// Check that no connectAuthEmulator(auth, "http://...) call is present
+	if strings.Contains(s, `connectAuthEmulator(auth`) {
+		t.Error("production home page should not call connectAuthEmulator")
+	}
+}
+
+func TestLoadFirebaseConfig_EmulatorWarningLevel(t *testing.T) {
+	t.Setenv("FIREBASE_PROJECT_ID", testProjectID)
+	t.Setenv("FIREBASE_API_KEY", "AIzaSyTestKey")
+	t.Setenv("FIREBASE_AUTH_DOMAIN", "test-project-123.firebaseapp.com")
+	t.Setenv("FIREBASE_AUTH_EMULATOR_HOST", "localhost:9099")
+
+	for flag, want := range map[string]string{"": "WARN", "true": "DEBUG"} {
+		t.Setenv("SUPPRESS_EMULATOR_WARNING", flag)
+		buf := captureLogs(t)
+		loadFirebaseConfig()
+		var entry map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var m map[string]any
+			if json.Unmarshal([]byte(line), &m) == nil && m["msg"] == "running with Firebase Auth emulator" {
+				entry = m
+			}
+		}
+		if entry == nil || entry["level"] != want {
+			t.Errorf("SUPPRESS_EMULATOR_WARNING=%q: emulator log = %v, want level %s", flag, entry, want)
+		}
+	}
+}
+
+// ── OAuth scopes ────────────────────────────────
+
+func TestProviderSetupSnippet_Scopes(t *testing.T) {
+	cfg := testCfg
+	cfg.GoogleScopes = []string{"https://www.googleapis.com/auth/calendar.readonly", "profile"}
+	snippet := providerSetupSnippet(cfg)
+	if !strings.Contains(snippet, `provider.addScope("https://www.googleapis.com/auth/calendar.readonly");`) {
+		t.Errorf("snippet missing calendar scope: %q", snippet)
+	}
+	if !strings.Contains(snippet, `provider.addScope("profile");`) {
+		t.Errorf("snippet missing profile scope: %q", snippet)
+	}
+}
+
+func TestProviderSetupSnippet_NoScopes(t *testing.T) {
+	if snippet := providerSetupSnippet(testCfg); snippet != "" {
+		t.Errorf("snippet should be empty without scopes, got %q", snippet)
+	}
+}
+
+func TestProviderSetupSnippet_CustomParameters(t *testing.T) {
+	cfg := testCfg
+	cfg.GoogleLoginHint = "jane@example.com"
+	cfg.GoogleHostedDomain = "example.com"
+	for _, page := range []string{homePage(cfg), profilePage(cfg)} {
+		if !strings.Contains(page, `provider.setCustomParameters({"hd":"example.com","login_hint":"jane@example.com"});`) {
+			t.Errorf("page missing setCustomParameters call")
+		}
+	}
+
+	cfg.GoogleLoginHint = ""
+	if snippet := providerSetupSnippet(cfg); !strings.Contains(snippet, `provider.setCustomParameters({"hd":"example.com"});`) {
+		t.Errorf("snippet = %q, want hd only", snippet)
+	}
+	if strings.Contains(providerSetupSnippet(testCfg), "setCustomParameters") {
+		t.Error("setCustomParameters emitted without configuration")
+	}
+}
+
+func TestPages_RenderScopes(t *testing.T) {
+	cfg := testCfg
+	cfg.GoogleScopes = []string{"https://www.googleapis.com/auth/calendar.readonly"}
+	srv := httptest.NewServer(newMux(cfg))
+	defer srv.Close()
+	for _, path := range []string{"/", "/profile"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), `provider.addScope("https://www.googleapis.com/auth/calendar.readonly")`) {
+			t.Errorf("%s: missing addScope call", path)
+		}
+	}
+}
+
+// ── HTTP method enforcement ─────────────────────
+
+func TestHome_POST_Rejected(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST /: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 405 && resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404 or 405", resp.StatusCode)
+	}
+}
+
+func TestHTMLRoutes_OPTIONS_204(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	for _, path := range []string{"/", "/profile"} {
+		req, _ := http.NewRequest("OPTIONS", srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("OPTIONS %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 204 {
+			t.Errorf("OPTIONS %s: status = %d, want 204", path, resp.StatusCode)
+		}
+		if allow := resp.Header.Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+			t.Errorf("OPTIONS %s: Allow = %q, want GET, HEAD, OPTIONS", path, allow)
+		}
+	}
+}
+
+func TestUnknownPath_OPTIONS(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		want     int
+		wantJSON bool
+	}{
+		{"/api/unknown", http.StatusNotFound, true},
+		{"/unknown", http.StatusNotFound, false},
+		{"/static/app.0000000000.css", http.StatusNoContent, false},
+	} {
+		rec := httptest.NewRecorder()
+		newMux(testCfg).ServeHTTP(rec, httptest.NewRequest("OPTIONS", tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("OPTIONS %s: status = %d, want %d", tc.path, rec.Code, tc.want)
+		}
+		var env errorEnvelope
+		isJSON := json.Unmarshal(rec.Body.Bytes(), &env) == nil
+		if isJSON != tc.wantJSON || (tc.wantJSON && env.Error.Code != codeNotFound) {
+			t.Errorf("OPTIONS %s: body = %q, JSON envelope wanted: %v", tc.path, rec.Body, tc.wantJSON)
+		}
+	}
+}
+
+func TestAPIMe_POST_Rejected(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/api/me", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST /api/me: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 405 && resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404 or 405", resp.StatusCode)
+	}
+}
+
+// ── Error reporting ─────────────────────────────
+
+// recordingReporter collects reported errors.
+type recordingReporter struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (r *recordingReporter) ReportError(ctx context.Context, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+func TestRecoveryMiddleware_ReportsPanic(t *testing.T) {
+	reporter := &recordingReporter{}
+	cfg := testCfg
+	cfg.ErrorReporter = reporter
+	captureLogs(t)
+	h := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), cfg)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/me", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	if len(reporter.errs) != 1 || !strings.Contains(reporter.errs[0].Error(), "boom") {
+		t.Errorf("reported = %v, want the panic", reporter.errs)
+	}
+}
+
+func TestAPIMe_KeyFetchFailureReported(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	prev := keyCache
+	keyCache = &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+	reporter := &recordingReporter{}
+	cfg := testCfg
+	cfg.ErrorReporter = reporter
+	captureLogs(t)
+
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, pk, "unreachable", validClaims()))
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if len(reporter.errs) != 1 || !errors.Is(reporter.errs[0], errKeyFetchFailed) {
+		t.Errorf("reported = %v, want the key fetch failure", reporter.errs)
+	}
+}
+
+func TestWebhookErrorReporter_Posts(t *testing.T) {
+	got := make(chan map[string]string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]string
+		json.NewDecoder(r.Body).Decode(&report)
+		got <- report
+	}))
+	defer srv.Close()
+
+	webhookErrorReporter{url: srv.URL}.ReportError(context.Background(), errors.New("certs unreachable"))
+	select {
+	case report := <-got:
+		if report["error"] != "certs unreachable" || report["time"] == "" {
+			t.Errorf("report = %v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report received")
+	}
+}
+
+// ── Inbound header stripping ────────────────────
+
+func TestStripHeadersMiddleware(t *testing.T) {
+	cfg := testCfg
+	cfg.StripHeaders = []string{"X-Request-Id", "X-Forwarded-For"}
+	trusted, _ := parseProxyPrefix("10.0.0.0/8")
+	cfg.TrustedProxies = []netip.Prefix{trusted}
+	var seen http.Header
+	h := stripHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+	}), cfg)
+
+	for _, tc := range []struct {
+		remoteAddr string
+		stripped   bool
+	}{
+		{"203.0.113.7:5555", true},
+		{"10.1.2.3:5555", false},
+	} {
+		req := httptest.NewRequest("GET", "/api/me", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-Request-Id", "spoofed")
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		req.Header.Set("Authorization", "Bearer a.b.c")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, name := range cfg.StripHeaders {
+			if present := seen.Get(name) != ""; present == tc.stripped {
+				t.Errorf("from %s: %s present = %v, want stripped = %v", tc.remoteAddr, name, present, tc.stripped)
+			}
+		}
+		if seen.Get("Authorization") != "Bearer a.b.c" {
+			t.Errorf("from %s: Authorization should be preserved", tc.remoteAddr)
+		}
+	}
+}
+
+func TestParseProxyPrefix(t *testing.T) {
+	if p, err := parseProxyPrefix("192.0.2.1"); err != nil || p.String() != "192.0.2.1/32" {
+		t.Errorf("single IP = %v, %v; want 192.0.2.1/32", p, err)
+	}
+	if _, err := parseProxyPrefix("not-an-ip"); err == nil {
+		t.Error("want an error for an invalid entry")
+	}
+}
+
+// ── Rejected methods ────────────────────────────
+
+func TestRejectMethodsMiddleware(t *testing.T) {
+	h := rejectMethodsMiddleware(newMux(testCfg))
+	for _, method := range []string{"TRACE", "CONNECT"} {
+		for _, path := range []string{"/", "/api/me", "/unknown"} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: status = %d, want 405", method, path, rec.Code)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /: status = %d, want 200", rec.Code)
+	}
+}
+
+// ── Trailing slash middleware ───────────────────
+
+func TestTrailingSlash_ProfileRedirects(t *testing.T) {
+	srv := httptest.NewServer(trailingSlashMiddleware(newMux(testCfg)))
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(srv.URL + "/profile/")
+	if err != nil {
+		t.Fatalf("GET /profile/: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 301 {
+		t.Errorf("status = %d, want 301", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/profile" {
+		t.Errorf("Location = %q, want /profile", loc)
+	}
+}
+
+func TestTrailingSlash_APIMeHandled(t *testing.T) {
+	srv := httptest.NewServer(trailingSlashMiddleware(newMux(testCfg)))
+	defer srv.Close()
+	kid := "key-slash"
+	privKey := generateTestKey(t, kid)
+	tok := signToken(t, privKey, kid, validClaims())
+	req, _ := http.NewRequest("GET", srv.URL+"/api/me/", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/me/: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if resp.Request.URL.Path != "/api/me" {
+		t.Errorf("final path = %q, want /api/me", resp.Request.URL.Path)
+	}
+}
+
+func TestTrailingSlash_NoOpenRedirect(t *testing.T) {
+	w := httptest.NewRecorder()
+	trailingSlashMiddleware(newMux(testCfg)).ServeHTTP(w, httptest.NewRequest("GET", "//evil.example/", nil))
+	if loc := w.Header().Get("Location"); strings.HasPrefix(loc, "//") {
+		t.Errorf("Location = %q, must not be protocol-relative", loc)
+	}
+}
+
+func TestTrailingSlash_KeepsEscapes(t *testing.T) {
+	for _, tc := range []struct{ path, want string }{
+		{"/profile%3Fx/", "/profile%3Fx"},
+		{"/a%20b/?q=1", "/a%20b?q=1"},
+	} {
+		w := httptest.NewRecorder()
+		trailingSlashMiddleware(newMux(testCfg)).ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if loc := w.Header().Get("Location"); loc != tc.want {
+			t.Errorf("%s: Location = %q, want %q", tc.path, loc, tc.want)
+		}
+	}
+}
+
+func TestTrailingSlash_RootUntouched(t *testing.T) {
+	srv := httptest.NewServer(trailingSlashMiddleware(newMux(testCfg)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("GET /: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// ── POST /api/verify/batch ──────────────────────
+
+func TestVerifyBatch_MixedResultsInOrder(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	kid := "key-batch"
+	pk := generateTestKey(t, kid)
+	valid := signToken(t, pk, kid, validClaims())
+	expired := validClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-1 * time.Hour))
+	other := validClaims()
+	other.Subject = "user-uid-other"
+	tokens := []string{valid, signToken(t, pk, kid, expired), "garbage", signToken(t, pk, kid, other)}
+
+	body, _ := json.Marshal(batchRequest{Tokens: tokens})
+	resp, err := http.Post(srv.URL+"/api/verify/batch", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("POST /api/verify/batch: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d, want 200; body = %s", resp.StatusCode, b)
+	}
+	var out batchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(out.Results) != len(tokens) {
+		t.Fatalf("got %d results, want %d", len(out.Results), len(tokens))
+	}
+	if r := out.Results[0]; r.User == nil || r.User.UID != "user-uid-abc123" {
+		t.Errorf("results[0] = %+v, want user-uid-abc123", r)
+	}
+	if r := out.Results[1]; r.Error == nil || r.User != nil {
+		t.Errorf("results[1] = %+v, want error for expired token", r)
+	}
+	if r := out.Results[2]; r.Error == nil || r.User != nil {
+		t.Errorf("results[2] = %+v, want error for garbage token", r)
+	}
+	if r := out.Results[3]; r.User == nil || r.User.UID != "user-uid-other" {
+		t.Errorf("results[3] = %+v, want user-uid-other", r)
+	}
+}
+
+func TestVerifyBatch_SingleTokenCodes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	prev := keyCache
+	keyCache = &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+	captureLogs(t)
+
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tokens := []string{
+		signToken(t, pk, "outage", validClaims()),
+		strings.Repeat("a", defaultMaxTokenBytes+1),
+	}
+	body, _ := json.Marshal(batchRequest{Tokens: tokens})
+	rec := httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, httptest.NewRequest("POST", "/api/verify/batch", strings.NewReader(string(body))))
+	var out batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || len(out.Results) != 2 {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for i, want := range []string{codeUnavailable, codeTokenTooLarge} {
+		if r := out.Results[i]; r.Error == nil || r.Error.Code != want {
+			t.Errorf("results[%d] = %+v, want %s", i, r.Error, want)
+		}
+	}
+}
+
+func TestVerifyBatch_EmptyRejected(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/api/verify/batch", "application/json", strings.NewReader(`{"tokens":[]}`))
+	if err != nil {
+		t.Fatalf("POST /api/verify/batch: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestVerifyBatch_Deadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results := verifyBatch(ctx, []string{"fast", "slow"}, 2, func(tok string) (*userClaims, error) {
+		if tok == "slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return &userClaims{UID: tok}, nil
+	})
+	if results[0].User == nil || results[0].User.UID != "fast" {
+		t.Errorf("results[0] = %+v, want fast", results[0])
+	}
+	if results[1].Error == nil || results[1].Error.Code != "DEADLINE_EXCEEDED" {
+		t.Errorf("results[1] = %+v, want DEADLINE_EXCEEDED", results[1])
+	}
+}
+
+func TestBatchResponse_OmitEmptyFields(t *testing.T) {
+	cfg := testCfg
+	cfg.OmitEmptyFields = true
+	results := []batchResult{
+		{User: &userClaims{UID: "phone-user"}},
+		{Error: &errorDetail{Code: codeUnauthenticated, Message: "Invalid authentication token"}},
+	}
+	b, _ := json.Marshal(batchResponseFor(results, cfg))
+	want := `{"results":[{"user":{"uid":"phone-user"}},{"error":{"code":"UNAUTHENTICATED","message":"Invalid authentication token"}}]}`
+	if string(b) != want {
+		t.Errorf("body = %s, want %s", b, want)
+	}
+}
+
+// ── Logging middleware ──────────────────────────
+
+// captureLogs redirects the default slog logger to a buffer for the
+// duration of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+// requestLogs returns the decoded "request" access log entries.
+func requestLogs(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		if json.Unmarshal([]byte(line), &m) == nil && m["msg"] == "request" {
+			entries = append(entries, m)
+		}
+	}
+	return entries
+}
+
+func TestLoggingMiddleware_Sampling(t *testing.T) {
+	buf := captureLogs(t)
+	cfg := testCfg
+	cfg.LogSampleRate = 10
+	h := loggingMiddleware(newMux(cfg), cfg)
+	for range 100 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	for range 10 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/me", nil))
+	}
+
+	counts := map[float64]int{}
+	for _, e := range requestLogs(t, buf) {
+		counts[e["status"].(float64)]++
+	}
+	if counts[200] != 10 {
+		t.Errorf("logged %d of 100 200s, want 10", counts[200])
+	}
+	if counts[401] != 10 {
+		t.Errorf("logged %d of 10 401s, want all 10", counts[401])
+	}
+}
+
+func TestLoggingMiddleware_NoSamplingByDefault(t *testing.T) {
+	buf := captureLogs(t)
+	h := loggingMiddleware(newMux(testCfg), testCfg)
+	for range 5 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if n := len(requestLogs(t, buf)); n != 5 {
+		t.Errorf("logged %d requests, want 5", n)
+	}
+}
+
+func TestResponseCapture_DoubleWriteHeader(t *testing.T) {
+	buf := captureLogs(t)
+	rec := httptest.NewRecorder()
+	rc := &responseCapture{ResponseWriter: rec, status: http.StatusOK}
+	rc.WriteHeader(http.StatusCreated)
+	rc.WriteHeader(http.StatusInternalServerError)
+	if rc.status != http.StatusCreated {
+		t.Errorf("captured status = %d, want 201", rc.status)
+	}
+	if rec.Code != http.StatusCreated {
+		t.Errorf("sent status = %d, want 201", rec.Code)
+	}
+	if !strings.Contains(buf.String(), "superfluous WriteHeader call ignored") {
+		t.Errorf("expected a warning, got:\n%s", buf.String())
+	}
+}
+
+func TestResponseCapture_WriteWithoutHeader(t *testing.T) {
+	buf := captureLogs(t)
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.WriteHeader(http.StatusTeapot) // too late: the 200 is already sent
+	}), testCfg)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	entries := requestLogs(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("got %d request logs, want 1", len(entries))
+	}
+	if status := entries[0]["status"]; status != float64(200) {
+		t.Errorf("logged status = %v, want 200", status)
+	}
+}
+
+func TestLoggingMiddleware_Route(t *testing.T) {
+	buf := captureLogs(t)
+	h := loggingMiddleware(newMux(testCfg), testCfg)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/me", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/nope", nil))
+
+	entries := requestLogs(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("got %d request logs, want 2", len(entries))
+	}
+	if route := entries[0]["route"]; route != "GET /api/me" {
+		t.Errorf("route = %v, want the pattern GET /api/me", route)
+	}
+	if route := entries[1]["route"]; route != "" {
+		t.Errorf("unmatched route = %v, want empty", route)
+	}
+}
+
+func TestLoggingMiddleware_CLF(t *testing.T) {
+	var out bytes.Buffer
+	prev := accessLogWriter
+	accessLogWriter = &out
+	t.Cleanup(func() { accessLogWriter = prev })
+
+	cfg := testCfg
+	cfg.LogFormat = "clf"
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), cfg)
+	req := httptest.NewRequest("GET", "/profile?tab=1", nil)
+	req.RemoteAddr = "192.0.2.7:54321"
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := strings.TrimSuffix(out.String(), "\n")
+	pattern := `^192\.0\.2\.7 - - \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /profile\?tab=1 HTTP/1\.1" 200 5 "https://example\.com/" "curl/8\.0 \\"quoted\\""$`
+	if !regexp.MustCompile(pattern).MatchString(line) {
+		t.Errorf("CLF line = %q, want match for %s", line, pattern)
+	}
+}
+
+func TestLoggingMiddleware_RequestHeaders(t *testing.T) {
+	buf := captureLogs(t)
+	cfg := testCfg
+	cfg.LogReqHeaders = true
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), cfg)
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("User-Agent", "test-agent/1.0")
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Referer", "https://app.example.com/profile")
+	req.Header.Set("Authorization", "Bearer secret-token-value")
+	req.Header.Set("Cookie", "session=secret-cookie")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	out := buf.String()
+	for _, want := range []string{`"user-agent":"test-agent/1.0"`, `"origin":"https://app.example.com"`, `"referer":"https://app.example.com/profile"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %s:\n%s", want, out)
+		}
+	}
+	for _, secret := range []string{"secret-token-value", "secret-cookie", "authorization"} {
+		if strings.Contains(strings.ToLower(out), secret) {
+			t.Errorf("log leaked %q:\n%s", secret, out)
+		}
+	}
+}
+
+func TestLoggingMiddleware_LatencyFields(t *testing.T) {
+	buf := captureLogs(t)
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}), testCfg)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	entries := requestLogs(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("got %d request logs, want 1", len(entries))
+	}
+	e := entries[0]
+	ms, ok1 := e["latency_ms"].(float64)
+	secs, ok2 := e["latency_seconds"].(float64)
+	human, ok3 := e["latency_human"].(string)
+	if !ok1 || !ok2 || !ok3 {
+		t.Fatalf("missing latency fields: %v", e)
+	}
+	if ms < 20 {
+		t.Errorf("latency_ms = %v, want >= 20", ms)
+	}
+	if d := secs*1000 - ms; d < -0.001 || d > 0.001 {
+		t.Errorf("latency_seconds = %v inconsistent with latency_ms = %v", secs, ms)
+	}
+	hd, err := time.ParseDuration(human)
+	if err != nil {
+		t.Fatalf("latency_human = %q: %v", human, err)
+	}
+	if d := hd.Seconds() - secs; d < -1e-6 || d > 1e-6 {
+		t.Errorf("latency_human = %q inconsistent with latency_seconds = %v", human, secs)
+	}
+}
+
+// ── Health ──────────────────────────────────────
+
+func healthStatus(t *testing.T, cfg firebaseConfig) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var h healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return rec.Code, h.Status
+}
+
+func TestHealth_Serving(t *testing.T) {
+	generateTestKey(t, "health-kid")
+	if code, status := healthStatus(t, testCfg); code != 200 || status != "SERVING" {
+		t.Errorf("health = %d %s, want 200 SERVING", code, status)
+	}
+}
+
+func TestHealth_Pretty(t *testing.T) {
+	generateTestKey(t, "health-pretty")
+	rec := httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, httptest.NewRequest("GET", "/health?pretty=1", nil))
+	if want := "{\n  \"status\": \"SERVING\"\n}\n"; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestHealth_NotServing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	prev := keyCache
+	keyCache = &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+
+	if code, status := healthStatus(t, testCfg); code != 503 || status != "NOT_SERVING" {
+		t.Errorf("health = %d %s, want 503 NOT_SERVING", code, status)
+	}
+	// The emulator needs no Google keys.
+	if code, status := healthStatus(t, emulatorCfg); code != 200 || status != "SERVING" {
+		t.Errorf("emulator health = %d %s, want 200 SERVING", code, status)
+	}
+}
+
+func TestHealth_LoadsKeysInBackground(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	prev := keyCache
+	keyCache = &publicKeyCache{url: newCertServer(t, "health-cold", pk).URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+	events := watchRefreshes(keyCache)
+
+	if code, status := healthStatus(t, testCfg); code != 503 || status != "NOT_SERVING" {
+		t.Errorf("cold health = %d %s, want 503 NOT_SERVING", code, status)
+	}
+	if ev := awaitRefresh(t, events); ev.err != nil {
+		t.Fatalf("background load: %v", ev.err)
+	}
+	if code, status := healthStatus(t, testCfg); code != 200 || status != "SERVING" {
+		t.Errorf("health = %d %s, want 200 SERVING after loading keys", code, status)
+	}
+}
+
+func TestHealth_DoesNotWaitForKeyFetch(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	prev := keyCache
+	keyCache = &publicKeyCache{url: newSlowCertServer(t, "health-slow", pk, time.Second).URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+
+	start := time.Now()
+	if code, _ := healthStatus(t, testCfg); code != 503 {
+		t.Errorf("health = %d, want 503 while the keys load", code)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("health took %s, want an answer without waiting for the fetch", elapsed)
+	}
+}
+
+// ── GET /version ────────────────────────────────
+
+func TestVersion(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// Commit is empty without ldflags or VCS info, but always present.
+	for _, key := range []string{"version", "commit", "go_version"} {
+		if _, ok := body[key]; !ok {
+			t.Errorf("missing %q in %s", key, rec.Body)
+		}
+	}
+	if body["version"] != buildVersion || !strings.HasPrefix(body["go_version"], "go") {
+		t.Errorf("version = %q, go_version = %q", body["version"], body["go_version"])
+	}
+}
+
+// ── GET /admin/config ───────────────────────────
+
+func TestAdminConfig_NotServedWithoutToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/config", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 when ADMIN_TOKEN is unset", rec.Code)
+	}
+}
+
+func TestAdminConfig_RequiresAdminToken(t *testing.T) {
+	cfg := testCfg
+	cfg.AdminToken = "admin-secret"
+	for _, auth := range []string{"", "Bearer wrong", "Basic admin-secret"} {
+		req := httptest.NewRequest("GET", "/admin/config", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		newMux(cfg).ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want 401", auth, rec.Code)
+		}
+	}
+}
+
+func TestAdminConfig_FeaturesAndMasking(t *testing.T) {
+	cfg := testCfg
+	cfg.APIKey = "AIzaSyEXAMPLEKEY1234"
+	cfg.AdminToken = "admin-secret"
+	cfg.DevBypassToken = "bypass-secret"
+	cfg.APIOnly = true
+	req := httptest.NewRequest("GET", "/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	newMux(cfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, secret := range []string{cfg.APIKey, "admin-secret", "bypass-secret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response leaks secret %q: %s", secret, body)
+		}
+	}
+	var got struct {
+		APIKey        string          `json:"api_key"`
+		MaxTokenBytes int             `json:"max_token_bytes"`
+		Features      map[string]bool `json:"features"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.APIKey != "****1234" {
+		t.Errorf("api_key = %q, want ****1234", got.APIKey)
+	}
+	if got.MaxTokenBytes != defaultMaxTokenBytes {
+		t.Errorf("max_token_bytes = %d, want default %d", got.MaxTokenBytes, defaultMaxTokenBytes)
+	}
+	if !got.Features["api_only"] || !got.Features["dev_bypass_token"] || got.Features["emulator"] {
+		t.Errorf("features = %v, want api_only and dev_bypass_token on, emulator off", got.Features)
+	}
+}
+
+// ── Metrics ─────────────────────────────────────
+
+func TestKeyCacheMetrics_AfterRefresh(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := newCertServer(t, "m-kid", pk)
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}, durations: newHistogram(0.1, 1)}
+	if _, err := c.getKey(context.Background(), "m-kid"); err != nil {
+		t.Fatalf("getKey: %v", err)
+	}
+
+	var buf bytes.Buffer
+	writeKeyCacheMetrics(&buf, c)
+	out := buf.String()
+
+	var age float64
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "key_cache_age_seconds ") {
+			age, _ = strconv.ParseFloat(strings.TrimPrefix(line, "key_cache_age_seconds "), 64)
+		}
+	}
+	if !strings.Contains(out, "\nkey_cache_age_seconds ") || age > 5 {
+		t.Errorf("age gauge should be near zero after refresh, got:\n%s", out)
+	}
+	if !strings.Contains(out, "key_cache_refresh_duration_seconds_count 1") {
+		t.Errorf("expected one observed refresh duration, got:\n%s", out)
+	}
+}
+
+func TestKeyCacheMetrics_NoAgeBeforeRefresh(t *testing.T) {
+	var buf bytes.Buffer
+	writeKeyCacheMetrics(&buf, &publicKeyCache{store: &memoryKeyStore{}})
+	if strings.Contains(buf.String(), "\nkey_cache_age_seconds ") {
+		t.Errorf("age gauge should be absent before the first refresh, got:\n%s", buf.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "# TYPE key_cache_refresh_duration_seconds histogram") {
+		t.Errorf("missing refresh duration histogram, got:\n%s", body)
+	}
+}
+
+func TestRouteLabel(t *testing.T) {
+	mux := newMux(testCfg)
+	serve := func(path string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+		return routeLabel(req)
+	}
+
+	if got := serve("/api/me"); got != "GET /api/me" {
+		t.Errorf("label = %q, want the pattern GET /api/me", got)
+	}
+	before := requestsByRoute.get(unmatchedRoute)
+	for _, path := range []string{"/users/123", "/users/456", "/api/nope"} {
+		if got := serve(path); got != unmatchedRoute {
+			t.Errorf("%s: label = %q, want %q", path, got, unmatchedRoute)
+		}
+	}
+	if n := requestsByRoute.get(unmatchedRoute) - before; n != 3 {
+		t.Errorf("unmatched count grew by %d, want 3", n)
+	}
+
+	var buf bytes.Buffer
+	requestsByRoute.write(&buf, "http_requests_total", "help")
+	if strings.Contains(buf.String(), "/users/") {
+		t.Errorf("metrics leak raw paths:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `http_requests_total{route="GET /api/me"}`) {
+		t.Errorf("metrics missing the route series:\n%s", buf.String())
+	}
+}
+
+func TestResponsesByRoute(t *testing.T) {
+	captureLogs(t)
+	cfg := testCfg
+	cfg.MissingVars = []string{"FIREBASE_PROJECT_ID"}
+	handler := loggingMiddleware(newMux(cfg), cfg)
+
+	type series struct{ route, class string }
+	want := map[series]uint64{
+		{"GET /version", "2xx"}: 2,
+		{"GET /api/me", "5xx"}:  1,
+		{"GET /health", "5xx"}:  1,
+		{unmatchedRoute, "4xx"}: 1,
+		{"GET /version", "5xx"}: 0,
+	}
+	before := map[series]uint64{}
+	for s := range want {
+		before[s] = responsesByRoute.get(s.route, s.class)
+	}
+	for _, path := range []string{"/version", "/version", "/api/me", "/health", "/nope"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	for s, n := range want {
+		if got := responsesByRoute.get(s.route, s.class) - before[s]; got != n {
+			t.Errorf("%s %s grew by %d, want %d", s.route, s.class, got, n)
+		}
+	}
+
+	var buf bytes.Buffer
+	responsesByRoute.write(&buf, "http_responses_total", "help")
+	if !strings.Contains(buf.String(), `http_responses_total{route="GET /health",status_class="5xx"}`) {
+		t.Errorf("metrics missing the route and class series:\n%s", buf.String())
+	}
+}
+
+func TestNotFound_CountedAndDebugLogged(t *testing.T) {
+	buf := captureLogs(t)
+	handler := newHandler(testCfg)
+	before := notFoundTotal.Load()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/wp-login.php", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", rec.Code)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/static/app.css", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/me", nil))
+	if n := notFoundTotal.Load() - before; n != 1 {
+		t.Errorf("notfound_total grew by %d, want 1", n)
+	}
+
+	levels := map[string]any{}
+	for _, e := range requestLogs(t, buf) {
+		levels[e["path"].(string)] = e["level"]
+	}
+	if levels["/wp-login.php"] != "DEBUG" {
+		t.Errorf("404 logged at %v, want DEBUG", levels["/wp-login.php"])
+	}
+	if levels["/api/me"] != "INFO" {
+		t.Errorf("401 logged at %v, want INFO", levels["/api/me"])
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "\nnotfound_total ") {
+		t.Errorf("metrics missing notfound_total:\n%s", rec.Body.String())
+	}
+}
+
+// ── Key store ───────────────────────────────────
+
+// fakeKeyStore records its calls so tests can assert how the cache uses
+// the store.
+type fakeKeyStore struct {
+	memoryKeyStore
+	gets, sets int
+	kids       []string // kids passed to Get
+}
+
+func (f *fakeKeyStore) Get(kid string) (*rsa.PublicKey, time.Time, bool) {
+	f.gets++
+	f.kids = append(f.kids, kid)
+	return f.memoryKeyStore.Get(kid)
+}
+
+func (f *fakeKeyStore) Set(keys map[string]*rsa.PublicKey, expiry time.Time) {
+	f.sets++
+	f.memoryKeyStore.Set(keys, expiry)
+}
+
+func TestKeyStore_RefreshPopulatesStore(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := newCertServer(t, "ks-kid", pk)
+	store := &fakeKeyStore{}
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: store}
+
+	key, err := c.getKey(context.Background(), "ks-kid")
+	if err != nil {
+		t.Fatalf("getKey: %v", err)
+	}
+	if key.N.Cmp(pk.N) != 0 {
+		t.Error("returned key doesn't match the served certificate")
+	}
+	if store.sets != 1 {
+		t.Errorf("store.Set called %d times, want 1", store.sets)
+	}
+	if _, expiry, ok := store.memoryKeyStore.Get("ks-kid"); !ok || time.Until(expiry) < 9*time.Minute {
+		t.Errorf("store should hold the key with the max-age expiry, got ok=%v expiry=%v", ok, expiry)
+	}
+
+	// A second lookup is served from the store without refreshing.
+	if _, err := c.getKey(context.Background(), "ks-kid"); err != nil {
+		t.Fatalf("getKey: %v", err)
+	}
+	if store.sets != 1 {
+		t.Errorf("store.Set called %d times after cached lookup, want 1", store.sets)
+	}
+}
+
+func TestKeyStore_ExpiryNotReadThroughGet(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &fakeKeyStore{}
+	c := &publicKeyCache{url: newCertServer(t, "ks-expiry", pk).URL, parse: parseX509Certs, store: store}
+
+	if _, err := c.getKey(context.Background(), "ks-expiry"); err != nil {
+		t.Fatalf("getKey: %v", err)
+	}
+	if !c.ready(context.Background()) {
+		t.Error("ready = false after loading the keys")
+	}
+	if slices.Contains(store.kids, "") {
+		t.Errorf("Get called with an empty kid: %q", store.kids)
+	}
+}
+
+func TestKeyStore_SharedKeysSkipFetch(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &fakeKeyStore{}
+	store.memoryKeyStore.Set(map[string]*rsa.PublicKey{"shared": &pk.PublicKey}, time.Now().Add(time.Hour))
+	// The URL is unreachable: any fetch attempt would fail.
+	c := &publicKeyCache{url: "http://127.0.0.1:0", parse: parseX509Certs, store: store}
+
+	if _, err := c.getKey(context.Background(), "shared"); err != nil {
+		t.Fatalf("getKey should be served from the store: %v", err)
+	}
+	if store.gets == 0 {
+		t.Error("store.Get was not consulted")
+	}
+	if store.sets != 0 {
+		t.Errorf("store.Set called %d times, want 0", store.sets)
+	}
+}
+
+func TestKeyCache_UnknownKidForcesRefresh(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	certs := newCertServer(t, "rotated", pk)
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		certs.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	old, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &memoryKeyStore{}
+	store.Set(map[string]*rsa.PublicKey{"previous": &old.PublicKey}, time.Now().Add(time.Hour))
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: store}
+
+	key, err := c.getKey(context.Background(), "rotated")
+	if err != nil {
+		t.Fatalf("getKey after early rotation: %v", err)
+	}
+	if key.N.Cmp(pk.N) != 0 {
+		t.Error("returned key doesn't match the rotated certificate")
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+
+	// Another unknown kid right away is rejected without refetching.
+	if _, err := c.getKey(context.Background(), "bogus"); !errors.Is(err, errUnknownKey) {
+		t.Errorf("err = %v, want errUnknownKey", err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d after second unknown kid, want 1", n)
+	}
+}
+
+func TestKeyCache_FailedForcedRefreshLimited(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	old, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &memoryKeyStore{}
+	store.Set(map[string]*rsa.PublicKey{"previous": &old.PublicKey}, time.Now().Add(time.Hour))
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: store}
+	captureLogs(t)
+
+	for _, kid := range []string{"unknown-1", "unknown-2"} {
+		if _, err := c.getKey(context.Background(), kid); !errors.Is(err, errUnknownKey) {
+			t.Errorf("%s: err = %v, want errUnknownKey", kid, err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d while the endpoint fails, want 1", n)
+	}
+}
+
+func TestKeyCache_UnknownKidRemembered(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	certs := newCertServer(t, "known", pk)
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		certs.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}, unknownKidTTL: 100 * time.Millisecond}
+	ctx := context.Background()
+
+	if _, err := c.getKey(ctx, "garbage"); !errors.Is(err, errUnknownKey) {
+		t.Fatalf("err = %v, want errUnknownKey", err)
+	}
+	// With the forced-refresh limit lifted, only the remembered kid stops
+	// the repeats from refetching.
+	for range 5 {
+		c.lastRefresh, c.lastForced = time.Time{}, time.Time{}
+		if _, err := c.getKey(ctx, "garbage"); !errors.Is(err, errUnknownKey) {
+			t.Fatalf("err = %v, want errUnknownKey", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d within the window, want 1", n)
+	}
+	if _, err := c.getKey(ctx, "known"); err != nil {
+		t.Errorf("known kid: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	c.lastRefresh, c.lastForced = time.Time{}, time.Time{}
+	c.getKey(ctx, "garbage")
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("fetches = %d after the window, want 2", n)
+	}
+}
+
+func TestKeyCache_ReadsNotBlockedDuringRefresh(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	certs := newCertServer(t, "new", pk)
+	fetchStarted, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetchStarted)
+		<-release
+		certs.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	old, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &memoryKeyStore{}
+	store.Set(map[string]*rsa.PublicKey{"old": &old.PublicKey}, time.Now().Add(-time.Minute))
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: store}
+	events := watchRefreshes(c)
+
+	// The expired set makes this lookup refresh; the fetch hangs.
+	go c.getKey(context.Background(), "old")
+	<-fetchStarted
+
+	lookup := make(chan error, 1)
+	go func() {
+		_, err := c.getKey(context.Background(), "old")
+		lookup <- err
+	}()
+	select {
+	case err := <-lookup:
+		if err != nil {
+			t.Errorf("getKey during refresh: %v, want the previous key", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("getKey blocked behind the in-flight refresh")
+	}
+
+	release <- struct{}{}
+	if ev := awaitRefresh(t, events); ev.err != nil || ev.keyCount != 1 {
+		t.Errorf("refresh = %+v, want the new key set", ev)
+	}
+	if _, err := c.getKey(context.Background(), "new"); err != nil {
+		t.Errorf("getKey after refresh: %v", err)
+	}
+}
+
+// newSlowCertServer is newCertServer answering after delay.
+func newSlowCertServer(t *testing.T, kid string, priv *rsa.PrivateKey, delay time.Duration) *httptest.Server {
+	t.Helper()
+	certs := newCertServer(t, kid, priv)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		certs.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestKeyCache_ColdStartWaitsForWarmup(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	prev := keyCache
+	keyCache = &publicKeyCache{
+		url:           newSlowCertServer(t, "v-warmup", pk, 200*time.Millisecond).URL,
+		parse:         parseX509Certs,
+		store:         &memoryKeyStore{},
+		coldStartWait: 5 * time.Second,
+	}
+	t.Cleanup(func() { keyCache = prev })
+	keyCache.warmup(context.Background())
+
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, pk, "v-warmup", validClaims()))
+	rec := httptest.NewRecorder()
+	newMux(testCfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200 once warmup completes; body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestKeyCache_ColdStartWaitExceeded(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	c := &publicKeyCache{
+		url:           newSlowCertServer(t, "slow", pk, time.Second).URL,
+		parse:         parseX509Certs,
+		store:         &memoryKeyStore{},
+		coldStartWait: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	if _, err := c.getKey(context.Background(), "slow"); !errors.Is(err, errKeyFetchFailed) {
+		t.Errorf("err = %v, want errKeyFetchFailed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("getKey took %v, want about the 50ms cold start wait", elapsed)
+	}
+}
+
+func TestKeyCache_ColdStartSingleWarmup(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}, coldStartWait: 10 * time.Millisecond}
+	events := watchRefreshes(c)
+	captureLogs(t)
+
+	// Each request gives up after 10ms; their warmups must not queue up
+	// behind the one in flight.
+	for range 5 {
+		if _, err := c.getKey(context.Background(), "kid"); !errors.Is(err, errKeyFetchFailed) {
+			t.Fatalf("err = %v, want errKeyFetchFailed", err)
+		}
+	}
+	awaitRefresh(t, events)
+	time.Sleep(300 * time.Millisecond)
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+}
+
+func TestKeyCache_FetchTimeout(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	prev := keyFetchClient
+	keyFetchClient = &http.Client{Timeout: 50 * time.Millisecond}
+	t.Cleanup(func() { keyFetchClient = prev })
+	c := &publicKeyCache{url: newSlowCertServer(t, "hung", pk, time.Second).URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+
+	start := time.Now()
+	if err := c.refresh(context.Background(), false); err == nil {
+		t.Error("refresh against a hung endpoint succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("refresh took %v, want about the 50ms client timeout", elapsed)
+	}
+}
+
+func TestKeyCache_GenerationIncrements(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := newCertServer(t, "v-generation", pk)
+	prev := keyCache
+	keyCache = &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+	buf := captureLogs(t)
+
+	if g := keyCache.generation.Load(); g != 0 {
+		t.Fatalf("generation before any refresh = %d, want 0", g)
+	}
+	if _, err := verifyIDToken(context.Background(), signToken(t, pk, "v-generation", validClaims()), testCfg); err != nil {
+		t.Fatalf("verifyIDToken: %v", err)
+	}
+	if g := keyCache.generation.Load(); g != 1 {
+		t.Errorf("generation after first refresh = %d, want 1", g)
+	}
+	if !strings.Contains(buf.String(), `"key_generation":1`) {
+		t.Errorf("verification log should carry key_generation 1, got:\n%s", buf.String())
+	}
+
+	keyCache.lastRefresh = time.Time{}
+	if err := keyCache.refresh(context.Background(), true); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if g := keyCache.generation.Load(); g != 2 {
+		t.Errorf("generation after second refresh = %d, want 2", g)
+	}
+}
+
+func TestKeyCache_RefreshLogsTriggeringRequest(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	prev := keyCache
+	keyCache = &publicKeyCache{url: newCertServer(t, "v-correlated", pk).URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	t.Cleanup(func() { keyCache = prev })
+	buf := captureLogs(t)
+
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, pk, "v-correlated", validClaims()))
+	rec := httptest.NewRecorder()
+	loggingMiddleware(newMux(testCfg), testCfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	var refreshLog, accessLog map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		json.Unmarshal([]byte(line), &m)
+		switch m["msg"] {
+		case "refreshed public keys":
+			refreshLog = m
+		case "request":
+			accessLog = m
+		}
+	}
+	if refreshLog == nil || accessLog == nil {
+		t.Fatalf("missing refresh or access log in:\n%s", buf)
+	}
+	if refreshLog["request_id"] != accessLog["request_id"] || refreshLog["scheduled"] != false {
+		t.Errorf("refresh log = %v, want request_id %v and scheduled false", refreshLog, accessLog["request_id"])
+	}
+
+	// A refresh outside any request gets a synthetic, scheduled ID.
+	buf.Reset()
+	keyCache.lastRefresh = time.Time{}
+	if err := keyCache.refresh(context.Background(), true); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if out := buf.String(); !strings.Contains(out, `"request_id":"refresh-`) || !strings.Contains(out, `"scheduled":true`) {
+		t.Errorf("background refresh log = %s, want a synthetic scheduled ID", out)
+	}
+}
+
+func TestKeyCache_EmptyResponseKeepsKeys(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}))
+	defer srv.Close()
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	store := &memoryKeyStore{}
+	store.Set(map[string]*rsa.PublicKey{"kept": &pk.PublicKey}, time.Now().Add(-time.Minute))
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: store}
+
+	if err := c.refresh(context.Background(), false); err == nil || !strings.Contains(err.Error(), "no keys") {
+		t.Errorf("refresh err = %v, want empty key set error", err)
+	}
+	if _, _, ok := store.Get("kept"); !ok {
+		t.Error("empty response clobbered the cached keys")
+	}
+	if c.generation.Load() != 0 {
+		t.Error("a failed refresh must not count as a generation")
+	}
+}
+
+func TestKeyCache_OversizedKeySetRejected(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pem := testCertPEM(t, pk)
+	certs := map[string]string{}
+	for i := range defaultMaxCachedKeys + 1 {
+		certs[fmt.Sprintf("kid-%d", i)] = pem
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, certs)
+	}))
+	defer srv.Close()
+	store := &memoryKeyStore{}
+	store.Set(map[string]*rsa.PublicKey{"kept": &pk.PublicKey}, time.Now().Add(-time.Minute))
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: store}
+
+	if err := c.refresh(context.Background(), false); err == nil || !strings.Contains(err.Error(), "limit of 20") {
+		t.Errorf("refresh err = %v, want the key limit error", err)
+	}
+	if _, _, ok := store.Get("kid-0"); ok {
+		t.Error("oversized key set was cached")
+	}
+	if _, _, ok := store.Get("kept"); !ok {
+		t.Error("oversized response clobbered the cached keys")
+	}
+
+	// A higher limit accepts the same set.
+	c.maxKeys = 50
+	if err := c.refresh(context.Background(), false); err != nil {
+		t.Errorf("refresh with maxKeys 50: %v", err)
+	}
+}
+
+func TestKeyCache_CertsFile(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	certs, _ := json.Marshal(map[string]string{"file-kid": testCertPEM(t, pk)})
+	path := t.TempDir() + "/certs.json"
+	if err := os.WriteFile(path, certs, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryKeyStore{}
+	prev := keyCache
+	keyCache = &publicKeyCache{url: "file://" + path, parse: parseX509Certs, store: store, fileTTL: 10 * time.Minute}
+	t.Cleanup(func() { keyCache = prev })
+
+	u, err := verifyIDToken(context.Background(), signToken(t, pk, "file-kid", validClaims()), testCfg)
+	if err != nil {
+		t.Fatalf("verifyIDToken against file keys: %v", err)
+	}
+	if u.UID != "user-uid-abc123" {
+		t.Errorf("uid = %q", u.UID)
+	}
+	if _, expiry, _ := store.Get("file-kid"); time.Until(expiry) > 10*time.Minute || time.Until(expiry) < 9*time.Minute {
+		t.Errorf("expiry in %v, want the 10m file TTL", time.Until(expiry))
+	}
+}
+
+func TestKeyCache_CertsFileMissing(t *testing.T) {
+	c := &publicKeyCache{url: "file://" + t.TempDir() + "/absent.json", parse: parseX509Certs, store: &memoryKeyStore{}}
+	if _, err := c.getKey(context.Background(), "any"); !errors.Is(err, errKeyFetchFailed) {
+		t.Errorf("err = %v, want errKeyFetchFailed", err)
+	}
+}
+
+// refreshEvent is one onRefresh call.
+type refreshEvent struct {
+	keyCount int
+	expiry   time.Time
+	err      error
+}
+
+// watchRefreshes installs an onRefresh hook on c that reports each
+// refresh attempt on the returned channel.
+func watchRefreshes(c *publicKeyCache) <-chan refreshEvent {
+	events := make(chan refreshEvent, 4)
+	c.onRefresh = func(keyCount int, expiry time.Time, err error) {
+		events <- refreshEvent{keyCount, expiry, err}
+	}
+	return events
+}
+
+// awaitRefresh waits for the next refresh attempt reported on events.
+func awaitRefresh(t *testing.T, events <-chan refreshEvent) refreshEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a key refresh")
+		return refreshEvent{}
+	}
+}
+
+func TestKeyCache_OnRefreshBackground(t *testing.T) {
+	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	c := &publicKeyCache{url: newCertServer(t, "hook-kid", pk).URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	events := watchRefreshes(c)
+
+	go c.getKey(context.Background(), "hook-kid")
+	ev := awaitRefresh(t, events)
+	if ev.err != nil || ev.keyCount != 1 {
+		t.Fatalf("refresh = %d keys, %v; want 1 key", ev.keyCount, ev.err)
+	}
+	if until := time.Until(ev.expiry); until < 9*time.Minute || until > 10*time.Minute {
+		t.Errorf("expiry in %v, want the 10m max-age", until)
+	}
+	if _, _, ok := c.store.Get("hook-kid"); !ok {
+		t.Error("store doesn't hold the refreshed key")
+	}
+
+	// A lookup served from the store is not a refresh attempt.
+	if _, err := c.getKey(context.Background(), "hook-kid"); err != nil {
+		t.Fatalf("getKey: %v", err)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected refresh %+v for a cached key", ev)
+	default:
+	}
+}
+
+func TestKeyCache_OnRefreshFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	c := &publicKeyCache{url: srv.URL, parse: parseX509Certs, store: &memoryKeyStore{}}
+	events := watchRefreshes(c)
+
+	go c.getKey(context.Background(), "any")
+	if ev := awaitRefresh(t, events); ev.err == nil || ev.keyCount != 0 || !ev.expiry.IsZero() {
+		t.Errorf("refresh = %+v, want a failure with no keys", ev)
+	}
+}
+
+// ── Log level ───────────────────────────────────
+
+func TestPrefixAttrKeys(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: prefixAttrKeys("app.")}))
+	logger.Info("request", "method", "GET", "status", 200)
+
+	var m map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	for _, key := range []string{"app.method", "app.status", "time", "level", "msg"} {
+		if _, ok := m[key]; !ok {
+			t.Errorf("missing key %q in %v", key, m)
+		}
+	}
+	for _, key := range []string{"method", "status"} {
+		if _, ok := m[key]; ok {
+			t.Errorf("unprefixed key %q still present", key)
+		}
+	}
+	if prefixAttrKeys("") != nil {
+		t.Error("empty prefix should leave keys untouched")
+	}
+}
+
+func TestLogLevel_TogglingLevelVar(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: &level}))
+
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("debug message emitted at info level: %s", buf.String())
+	}
+	level.Set(slog.LevelDebug)
+	logger.Debug("shown")
+	if !strings.Contains(buf.String(), "shown") {
+		t.Error("debug message not emitted after lowering the level")
+	}
+}
+
+func TestReloadLogLevel_FromFile(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	path := t.TempDir() + "/level"
+	os.WriteFile(path, []byte("debug\n"), 0o600)
+	t.Setenv("LOG_LEVEL", "error")
+	t.Setenv("LOG_LEVEL_FILE", path)
+
+	if err := reloadLogLevel(); err != nil {
+		t.Fatalf("reloadLogLevel: %v", err)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("level = %v, want DEBUG from file", logLevel.Level())
+	}
+
+	os.WriteFile(path, []byte("warn"), 0o600)
+	reloadLogLevel()
+	if logLevel.Level() != slog.LevelWarn {
+		t.Errorf("level = %v, want WARN after file change", logLevel.Level())
+	}
+}
+
+func TestReloadLogLevel_Invalid(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	t.Setenv("LOG_LEVEL", "chatty")
+	if err := reloadLogLevel(); err == nil {
+		t.Error("expected error for invalid level")
 	}
 }